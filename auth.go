@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+//Health probes, which skip the API key and rate limit so load balancers need
+//no secret and are never throttled
+var probePaths = map[string]struct{}{
+	"/health": struct{}{},
+	"/ready":  struct{}{},
+}
+
+//With -api-key set, every other request must carry the key in X-API-Key or
+//as an Authorization bearer token
+func requireAPIKey(h http.Handler) http.Handler {
+	if cfg.apiKey == "" {
+		return h
+	}
+	want := []byte(cfg.apiKey)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := probePaths[r.URL.Path]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		got := r.Header.Get("X-API-Key")
+		if got == "" {
+			got, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		//Constant time so response timing doesn't reveal how much of a guess matched
+		if subtle.ConstantTimeCompare([]byte(got), want) != 1 {
+			logger.Warn("Rejected request without a valid API key", "requestID", requestID(r.Context()), "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ip2loc"`)
+			http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIKey(t *testing.T) {
+	keepConfig(t)
+	cfg.apiKey = "s3cret"
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := requireAPIKey(ok)
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		want   int
+	}{
+		{"missing", "/lookup", "", "", 401},
+		{"wrong", "/lookup", "X-API-Key", "guess", 401},
+		{"prefix of the key", "/lookup", "X-API-Key", "s3c", 401},
+		{"wrong bearer", "/lookup", "Authorization", "Bearer guess", 401},
+		{"not a bearer token", "/lookup", "Authorization", "Basic s3cret", 401},
+		{"correct", "/lookup", "X-API-Key", "s3cret", 200},
+		{"correct bearer", "/lookup", "Authorization", "Bearer s3cret", 200},
+		{"health needs none", "/health", "", "", 200},
+		{"ready needs none", "/ready", "", "", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			rr := serveRequest(h, r)
+			if rr.Code != tt.want {
+				t.Errorf("Status %d, want %d", rr.Code, tt.want)
+			}
+			if tt.want == 401 && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+
+	cfg.apiKey = ""
+	if rr := get(requireAPIKey(ok), "/lookup"); rr.Code != 200 {
+		t.Errorf("Status %d without -api-key, want 200", rr.Code)
+	}
+}
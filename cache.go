@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+//Parsed records shared by every handler, so the pipeline only runs on a cold
+//cache or an explicit refresh
+type recCache struct {
+	mu       sync.RWMutex
+	recs     []ip2locRec
+	loadedAt time.Time
+	summary  *datasetStats
+	//Release date of recs, zero if the data gives none
+	datasetDate time.Time
+
+	//Indices into recs for each upper-case country code
+	byCountry map[string][]int
+	//Indices into recs for each lower-cased city name, for /search
+	byCity map[string][]int
+	//Only set when ranges overlap
+	intervals *intervalIndex
+	//Only set for -lookup-index=trie
+	trie *ipv4Trie
+
+	//Upstream version of recs, so refreshes can skip unchanged data
+	version validators
+
+	//Parent of every load; cancelled on shutdown. A load also stops early when
+	//every request waiting on it has gone away.
+	ctx context.Context
+
+	//Concurrent refreshes share a single in-flight load
+	flightMu sync.Mutex
+	flight   *loadCall
+	//Guarded by flightMu; how the last load to run its course failed, nil if
+	//it succeeded
+	lastErr *appError
+	//Guarded by flightMu; reparse was called while a load was in flight
+	reparsePending bool
+}
+
+//An in-flight load; result and err are set before done is closed
+type loadCall struct {
+	result []ip2locRec
+	err    *appError
+	done   chan struct{}
+
+	//Guarded by recCache.flightMu; the load is cancelled once nobody waits on it
+	waiters int
+	cancel  context.CancelFunc
+	//A background waiter from prime keeps the load alive
+	primed bool
+	//Root of the load's trace. A load outlives and is shared by the requests
+	//waiting on it, so rather than a child of the first it links to each.
+	span trace.Span
+}
+
+var cache = &recCache{ctx: context.Background()}
+
+//Returned while the first load is still running
+var errLoading = errors.New("Dataset not loaded yet")
+
+//Seconds a client should wait before retrying a request refused by errLoading
+const loadingRetryAfter = 5
+
+//Return the cached records, loading them first if the cache is cold
+func (c *recCache) get(ctx context.Context) ([]ip2locRec, *appError) {
+	if recs, ok := c.loaded(); ok {
+		return recs, nil
+	}
+	return c.refresh(ctx)
+}
+
+//The cached records, or false if nothing has loaded yet
+func (c *recCache) loaded() ([]ip2locRec, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.recs, c.recs != nil
+}
+
+//One load's records with what was derived from them, read together
+type cacheView struct {
+	recs      []ip2locRec
+	byCountry map[string][]int
+	byCity    map[string][]int
+	intervals *intervalIndex
+	trie      *ipv4Trie
+	loadedAt  time.Time
+}
+
+//Like loaded, plus the country index and the time those records were loaded
+func (c *recCache) snapshot() (cacheView, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return cacheView{c.recs, c.byCountry, c.byCity, c.intervals, c.trie, c.loadedAt}, c.recs != nil
+}
+
+//The record whose range covers ip. IPv6 editions of the dataset keep IPv4
+//ranges at ::ffff:0:0/96, so an IPv4 address no range covers is looked up
+//again as ::ffff:ip.
+func (v cacheView) lookup(ip *big.Int) (ip2locRec, bool) {
+	if rec, ok := v.find(ip); ok || ip.Cmp(maxIPv4) > 0 {
+		return rec, ok
+	}
+	return v.find(new(big.Int).Add(v4Mapped, ip))
+}
+
+//lookup without the IPv4-mapped retry
+func (v cacheView) find(ip *big.Int) (ip2locRec, bool) {
+	if v.trie != nil && v.trie.covers(ip) {
+		return v.trie.find(v.recs, ip)
+	}
+	if v.intervals != nil {
+		return v.intervals.find(v.recs, ip)
+	}
+	return lookup(v.recs, ip)
+}
+
+//Why a cold cache has no records: the last load's error, or nil while a
+//load is running or before any has finished
+func (c *recCache) loadError() *appError {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	if c.flight != nil {
+		return nil
+	}
+	return c.lastErr
+}
+
+//Start loading a cold cache without waiting for it. The load runs to
+//completion even if every request that waited on it has gone away.
+func (c *recCache) prime() {
+	if _, ok := c.loaded(); ok {
+		return
+	}
+	c.background()
+}
+
+//Reload in the background even if upstream reports the data unchanged, for
+//settings that change how rows are parsed. A load already in flight may have
+//read the old settings or asked upstream for changes since the old version,
+//so the reload starts once it is done.
+func (c *recCache) reparse() {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	if c.flight != nil {
+		c.reparsePending = true
+		return
+	}
+	c.mu.Lock()
+	c.version = validators{}
+	c.mu.Unlock()
+	c.backgroundLocked()
+}
+
+//Start a load, or keep the in-flight one alive, without waiting for it
+func (c *recCache) background() {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	c.backgroundLocked()
+}
+
+//background with flightMu already held
+func (c *recCache) backgroundLocked() {
+	if c.flight != nil && c.flight.primed {
+		return
+	}
+	call := c.joinLocked(context.Background())
+	call.primed = true
+	go func() {
+		<-call.done
+		c.leave(call)
+	}()
+}
+
+//Run the pipeline and swap in the result. Callers arriving while a load is
+//in flight wait for it instead of starting their own; ctx only bounds the wait.
+func (c *recCache) refresh(ctx context.Context) ([]ip2locRec, *appError) {
+	call := c.join(ctx)
+	defer c.leave(call)
+	select {
+	case <-call.done:
+		return call.result, call.err
+	case <-ctx.Done():
+		return nil, &appError{ctx.Err(), "Cancelled while preparing IP2Location data", 503}
+	}
+}
+
+//Return the in-flight load, starting one if there is none, and link its span
+//to the one in ctx. Every join must be paired with a leave.
+func (c *recCache) join(ctx context.Context) *loadCall {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	return c.joinLocked(ctx)
+}
+
+//join with flightMu already held
+func (c *recCache) joinLocked(ctx context.Context) *loadCall {
+	if c.flight == nil {
+		loadCtx, cancel := context.WithCancel(c.ctx)
+		loadCtx, span := tracer.Start(loadCtx, "load", trace.WithNewRoot())
+		call := &loadCall{done: make(chan struct{}), cancel: cancel, span: span}
+		c.flight = call
+		go c.run(loadCtx, call)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		c.flight.span.AddLink(trace.Link{SpanContext: sc})
+	}
+	c.flight.waiters++
+	return c.flight
+}
+
+//Once every caller has gone, e.g. clients disconnected mid-parse, the load stops
+func (c *recCache) leave(call *loadCall) {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		//Later callers start a fresh load rather than joining a cancelled one
+		if c.flight == call {
+			c.flight = nil
+		}
+	}
+}
+
+func (c *recCache) run(ctx context.Context, call *loadCall) {
+	//Only ask upstream for changes when there is a dataset to keep
+	c.mu.RLock()
+	var cond validators
+	if c.recs != nil {
+		cond = c.version
+	}
+	c.mu.RUnlock()
+
+	var recs []ip2locRec
+	res, e := load(ctx, cond, func(rec *ip2locRec) {
+		recs = append(recs, *rec)
+	})
+
+	if e != nil && e.Error == errNotModified {
+		log.Print("Upstream dataset unchanged, keeping cached records")
+		call.result, _ = c.loaded()
+		c.finish(call)
+		return
+	}
+
+	if e == nil {
+		if recs == nil {
+			//Distinguish an empty dataset from a cold cache
+			recs = []ip2locRec{}
+		}
+		//The CSV should arrive ordered by range end, but lookup depends on it
+		less := func(i, j int) bool { return recs[i].ToIP.Cmp(&recs[j].ToIP) < 0 }
+		if !sort.SliceIsSorted(recs, less) {
+			log.Print("Dataset is not ordered by toIP, sorting it; -strict-order rejects such data instead")
+			sort.SliceStable(recs, less)
+		}
+	}
+	call.result, call.err = recs, e
+	//A load abandoned by its waiters or by shutdown says nothing about upstream
+	if ctx.Err() == nil {
+		c.flightMu.Lock()
+		c.lastErr = e
+		c.flightMu.Unlock()
+	}
+
+	if e == nil {
+		byCountry := indexCountries(recs)
+		byCity := indexCities(recs)
+		intervals := buildIntervals(recs)
+		if intervals != nil {
+			log.Print("Dataset has overlapping ranges, lookups return the innermost match")
+		}
+		var trie *ipv4Trie
+		if cfg.lookupIndex == "trie" {
+			trie = buildTrie(recs)
+			if len(trie.nodes) == 1 {
+				log.Print("Dataset has no IPv4 ranges to index, lookups use binary search despite -lookup-index=trie")
+				trie = nil
+			} else {
+				log.Printf("Built IPv4 lookup trie: %d nodes", len(trie.nodes))
+			}
+		}
+		summary := computeStats(recs, byCountry)
+		summary.SkippedRows = res.skipped.count
+		summary.SkippedSample = res.skipped.sample
+		if !res.date.IsZero() {
+			summary.DatasetDate = &res.date
+		}
+		c.mu.Lock()
+		c.recs = recs
+		c.loadedAt = time.Now()
+		c.summary = summary
+		c.datasetDate = res.date
+		c.byCountry = byCountry
+		c.byCity = byCity
+		c.intervals = intervals
+		c.trie = trie
+		c.version = res.version
+		c.mu.Unlock()
+		mtr.records.Set(float64(len(recs)))
+	}
+	c.finish(call)
+}
+
+//Detach a completed load so the next refresh starts a new one
+func (c *recCache) finish(call *loadCall) {
+	c.flightMu.Lock()
+	if c.flight == call {
+		c.flight = nil
+	}
+	//If another load started once this one was detached, the reparse waits
+	//for that one instead
+	pending := c.reparsePending && c.flight == nil
+	if pending {
+		c.reparsePending = false
+	}
+	c.flightMu.Unlock()
+	var err error
+	if call.err != nil {
+		err = call.err.Error
+	}
+	endSpan(call.span, err)
+	call.cancel()
+	close(call.done)
+	if pending {
+		c.reparse()
+	}
+}
+
+//Built once per load so country filters needn't scan every record. Each
+//slice is in record order.
+func indexCountries(recs []ip2locRec) map[string][]int {
+	idx := make(map[string][]int)
+	for i := range recs {
+		code := strings.ToUpper(recs[i].CountryCode)
+		idx[code] = append(idx[code], i)
+	}
+	return idx
+}
+
+//Like indexCountries, keyed by lower-cased city; records without one are left out
+func indexCities(recs []ip2locRec) map[string][]int {
+	idx := make(map[string][]int)
+	for i := range recs {
+		if recs[i].City == "" {
+			continue
+		}
+		city := strings.ToLower(recs[i].City)
+		idx[city] = append(idx[city], i)
+	}
+	return idx
+}
+
+//Computed once per load, and nil until the first one succeeds
+func (c *recCache) stats() (*datasetStats, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.summary, c.loadedAt
+}
+
+//Zero when nothing has loaded or the data gives no date
+func (c *recCache) dataDate() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.datasetDate
+}
+
+//Zero until the first successful load
+func (c *recCache) lastRefresh() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.loadedAt
+}
+
+//Startup load for -eager. A failed load is tried again, waiting twice as
+//long each time up to maxFetchBackoff, until one succeeds or ctx is
+//cancelled. /ready stays 503 meanwhile, so an upstream that is down at
+//startup holds traffic back rather than stopping the server.
+func (c *recCache) preload(ctx context.Context) {
+	log.Print("Loading dataset")
+	start := time.Now()
+	delay := max(cfg.fetchBackoff, time.Second)
+	for attempt := 1; ; attempt++ {
+		recs, e := c.refresh(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if e == nil {
+			log.Printf("Loaded dataset: %d records in %s", len(recs), time.Since(start).Round(time.Millisecond))
+			return
+		}
+		log.Printf("Startup load attempt %d failed, retrying in %s: %v\n%s", attempt, delay, e.Error, e.Message)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		delay = min(2*delay, maxFetchBackoff)
+	}
+}
+
+//Reload on every tick until ctx is cancelled. A failed refresh keeps serving
+//the previous records.
+func (c *recCache) refreshEvery(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if recs, e := c.refresh(ctx); e != nil {
+				log.Printf("Refresh failed, keeping previous dataset: %v\n%s", e.Error, e.Message)
+			} else {
+				log.Printf("Refreshed dataset: %d records", len(recs))
+			}
+		}
+	}
+}
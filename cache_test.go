@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//An upstream holding every response until release is closed
+type gatedUpstream struct {
+	*httptest.Server
+	hits    atomic.Int32
+	release chan struct{}
+}
+
+func newGatedUpstream(t *testing.T, data []byte) *gatedUpstream {
+	u := &gatedUpstream{release: make(chan struct{})}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		select {
+		case <-u.release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+//Blocks until n callers are waiting on the in-flight load
+func waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cache.flightMu.Lock()
+		waiting := 0
+		if cache.flight != nil {
+			waiting = cache.flight.waiters
+		}
+		cache.flightMu.Unlock()
+		if waiting == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers waiting on the load, want %d", waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//Requests share the load's signalling, so one client going away must neither
+//cancel the load for the others nor close anything twice
+func TestConcurrentRequestsIsolated(t *testing.T) {
+	up := newGatedUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+
+	const requests, gone = 20, 5
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/lookup?ip=1.0.0.5", nil)
+			if i < gone {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			codes[i] = serveRequest(appHandler(ip2locLookup), r).Code
+		}(i)
+	}
+	waitForWaiters(t, requests-gone)
+	close(up.release)
+	wg.Wait()
+
+	for i, code := range codes {
+		want := 200
+		if i < gone {
+			want = 503
+		}
+		if code != want {
+			t.Errorf("Request %d answered %d, want %d", i, code, want)
+		}
+	}
+}
+
+func TestSimultaneousFirstRequestsShareOneLoad(t *testing.T) {
+	up := newGatedUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+
+	const requests = 20
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, e := cache.get(context.Background()); e != nil {
+				failed.Add(1)
+			}
+		}()
+	}
+	waitForWaiters(t, requests)
+	close(up.release)
+	wg.Wait()
+
+	if n := failed.Load(); n != 0 {
+		t.Errorf("%d of %d requests failed", n, requests)
+	}
+	if n := up.hits.Load(); n != 1 {
+		t.Errorf("Upstream fetched %d times, want once", n)
+	}
+	//Warm now, so a later request is served from memory
+	cache.get(context.Background())
+	if n := up.hits.Load(); n != 1 {
+		t.Errorf("Warm cache fetched again: %d fetches", n)
+	}
+}
+
+//Once every waiter has left, the load is abandoned and the next request
+//starts a fresh one
+func TestLoadCancelledWhenEveryWaiterLeaves(t *testing.T) {
+	up := newGatedUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *appError)
+	go func() {
+		_, e := cache.get(ctx)
+		done <- e
+	}()
+	waitForWaiters(t, 1)
+	for up.hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if e := <-done; e == nil || e.Code != 503 {
+		t.Fatalf("Abandoned request got %v, want a 503", e)
+	}
+
+	close(up.release)
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Next request failed: %v: %s", e.Error, e.Message)
+	}
+	if n := up.hits.Load(); n != 2 {
+		t.Errorf("Upstream fetched %d times, want 2", n)
+	}
+}
+
+//An upstream that is down at startup delays readiness rather than ending the
+//server; the load is retried until it succeeds
+func TestPreloadRetries(t *testing.T) {
+	data := testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV)
+	var hits atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			http.Error(w, "down", 500)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(up.Close)
+	useUpstream(t, up.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.preload(context.Background())
+	}()
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if rr := get(http.HandlerFunc(ready), "/ready"); rr.Code != 503 {
+		t.Errorf("/ready answered %d after the failed load, want 503", rr.Code)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Preload did not finish after upstream came back")
+	}
+	if rr := get(http.HandlerFunc(ready), "/ready"); rr.Code != 200 {
+		t.Errorf("/ready answered %d after the retried load, want 200", rr.Code)
+	}
+}
+
+//Cancelled while waiting to retry, once the failed load has finished with the
+//settings the test restores
+func TestPreloadStopsOnCancel(t *testing.T) {
+	var hits atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", 500)
+	}))
+	t.Cleanup(failing.Close)
+	useUpstream(t, failing.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.preload(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cache.flightMu.Lock()
+		loading := cache.flight != nil
+		cache.flightMu.Unlock()
+		if hits.Load() > 0 && !loading {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("First load attempt did not fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Preload still retrying a second after its context was cancelled")
+	}
+}
+
+//Every record is listed exactly once, in record order, under its upper-cased
+//country code, for the loaded dataset as well as a mixed-case one
+func TestIndexCountries(t *testing.T) {
+	useTestData(t)
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	view, _ := cache.snapshot()
+	mixed := []ip2locRec{testRec(1, 1, "us"), testRec(2, 2, "CN"), testRec(3, 3, "US"), testRec(4, 4, "Cn"), testRec(5, 5, "AU")}
+
+	for name, tt := range map[string]struct {
+		recs []ip2locRec
+		idx  map[string][]int
+	}{
+		"loaded": {view.recs, view.byCountry},
+		"mixed":  {mixed, indexCountries(mixed)},
+	} {
+		seen := make([]int, len(tt.recs))
+		for code, idx := range tt.idx {
+			for j, i := range idx {
+				if j > 0 && i <= idx[j-1] {
+					t.Errorf("%s: %s index %v is not in record order", name, code, idx)
+				}
+				if got := strings.ToUpper(tt.recs[i].CountryCode); got != code {
+					t.Errorf("%s: record %d of %s is in %s", name, i, got, code)
+				}
+				seen[i]++
+			}
+		}
+		for i, n := range seen {
+			if n != 1 {
+				t.Errorf("%s: record %d (%s) indexed %d times", name, i, tt.recs[i].CountryCode, n)
+			}
+		}
+	}
+	if got := indexCountries(mixed)["US"]; len(got) != 2 || got[0] != 0 || got[1] != 2 {
+		t.Errorf("US records at %v, want [0 2]", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math/big"
+	"net/netip"
+)
+
+var (
+	maxIPv4  = new(big.Int).SetUint64(1<<32 - 1)
+	v4Mapped = new(big.Int).Lsh(big.NewInt(0xffff), 32)
+	maxV4Map = new(big.Int).Add(v4Mapped, maxIPv4)
+)
+
+//The smallest set of aligned prefixes covering the inclusive range from-to.
+//Ranges within 0-2^32-1 or ::ffff:0:0/96 are written as IPv4 prefixes, the
+//rest as IPv6.
+func rangeCIDRs(from, to *big.Int) []string {
+	prefixes := rangePrefixes(from, to)
+	cidrs := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		cidrs[i] = p.String()
+	}
+	return cidrs
+}
+
+//rangeCIDRs before formatting
+func rangePrefixes(from, to *big.Int) []netip.Prefix {
+	if from.Cmp(to) > 0 {
+		return nil
+	}
+	width, offset := 128, new(big.Int)
+	switch {
+	case to.Cmp(maxIPv4) <= 0:
+		width = 32
+	case from.Cmp(v4Mapped) >= 0 && to.Cmp(maxV4Map) <= 0:
+		width, offset = 32, v4Mapped
+	}
+
+	var prefixes []netip.Prefix
+	cur := new(big.Int).Sub(from, offset)
+	end := new(big.Int).Sub(to, offset)
+	one := big.NewInt(1)
+	for cur.Cmp(end) <= 0 {
+		//Largest block aligned at cur that does not run past end
+		size := width
+		if cur.Sign() != 0 {
+			size = int(cur.TrailingZeroBits())
+		}
+		for ; size > 0; size-- {
+			last := new(big.Int).Lsh(one, uint(size))
+			last.Add(last, cur).Sub(last, one)
+			if last.Cmp(end) <= 0 {
+				break
+			}
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(intToAddr(cur, width), width-size))
+		cur.Add(cur, new(big.Int).Lsh(one, uint(size)))
+	}
+	return prefixes
+}
+
+//n as a 32 or 128 bit address
+func intToAddr(n *big.Int, width int) netip.Addr {
+	if width == 32 {
+		var b [4]byte
+		n.FillBytes(b[:])
+		return netip.AddrFrom4(b)
+	}
+	var b [16]byte
+	n.FillBytes(b[:])
+	return netip.AddrFrom16(b)
+}
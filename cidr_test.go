@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/big"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+//addr as the integer the CSV would give for it. Unlike parseIP, this keeps
+//IPv4-mapped addresses in ::ffff:0:0/96 as IP2Location's IPv6 files do.
+func addrInt(t testing.TB, addr string) *big.Int {
+	t.Helper()
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := a.AsSlice()
+	return new(big.Int).SetBytes(b)
+}
+
+func TestRangeCIDRs(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     []string
+	}{
+		{"1.0.0.0", "1.0.0.255", []string{"1.0.0.0/24"}},
+		{"1.0.0.7", "1.0.0.7", []string{"1.0.0.7/32"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"1.0.0.1", "1.0.0.6", []string{"1.0.0.1/32", "1.0.0.2/31", "1.0.0.4/31", "1.0.0.6/32"}},
+		{"10.0.0.0", "10.0.2.255", []string{"10.0.0.0/23", "10.0.2.0/24"}},
+		{"1.0.0.5", "1.0.1.3", []string{"1.0.0.5/32", "1.0.0.6/31", "1.0.0.8/29", "1.0.0.16/28", "1.0.0.32/27", "1.0.0.64/26", "1.0.0.128/25", "1.0.1.0/30"}},
+		//IPv4-mapped ranges are written as IPv4
+		{"::ffff:1.0.0.0", "::ffff:1.0.1.255", []string{"1.0.0.0/23"}},
+		{"::ffff:1.0.0.1", "::ffff:1.0.0.6", []string{"1.0.0.1/32", "1.0.0.2/31", "1.0.0.4/31", "1.0.0.6/32"}},
+		{"::ffff:0.0.0.0", "::ffff:255.255.255.255", []string{"0.0.0.0/0"}},
+		//unless they run out of ::ffff:0:0/96
+		{"::fffe:ffff:ffff", "::ffff:0.0.0.1", []string{"::fffe:ffff:ffff/128", "::ffff:0.0.0.0/127"}},
+		{"2001:db8::", "2001:db8:0:1:ffff:ffff:ffff:ffff", []string{"2001:db8::/63"}},
+		{"2001:db8::1", "2001:db8::8", []string{"2001:db8::1/128", "2001:db8::2/127", "2001:db8::4/126", "2001:db8::8/128"}},
+		{"2001:db8::ff", "2001:db8::1:0", []string{"2001:db8::ff/128", "2001:db8::100/120", "2001:db8::200/119", "2001:db8::400/118", "2001:db8::800/117", "2001:db8::1000/116", "2001:db8::2000/115", "2001:db8::4000/114", "2001:db8::8000/113", "2001:db8::1:0/128"}},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"1.0.0.2", "1.0.0.1", nil},
+	}
+	for _, tt := range tests {
+		got := rangeCIDRs(addrInt(t, tt.from), addrInt(t, tt.to))
+		if !slices.Equal(got, tt.want) && (len(got) != 0 || len(tt.want) != 0) {
+			t.Errorf("rangeCIDRs(%s, %s) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
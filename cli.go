@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+//The parse subcommand: run the pipeline once and write NDJSON to stdout.
+//Returns the process exit code.
+func runParse() int {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	var encErr error
+	res, e := load(ctx, validators{}, func(rec *ip2locRec) {
+		if encErr != nil {
+			return
+		}
+		if encErr = enc.Encode(rec); encErr != nil {
+			cancel()
+		}
+	})
+	if err := out.Flush(); err != nil && encErr == nil {
+		encErr = err
+	}
+
+	if encErr != nil {
+		fmt.Fprintf(os.Stderr, "Error writing records: %v\n", encErr)
+		return 1
+	}
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", e.Message, e.Error)
+		return 1
+	}
+	reportSkipped(os.Stderr, res.skipped)
+	return 0
+}
+
+//Context for a one-shot subcommand, done on SIGINT or SIGTERM or once cancel
+//is called, such as when writing the records out has failed
+func commandContext() (ctx context.Context, cancel context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancelCtx := context.WithCancel(ctx)
+	return ctx, func() {
+		cancelCtx()
+		stop()
+	}
+}
+
+//Lists the rows -lenient passed over, as far as the sample goes, then the total
+func reportSkipped(w io.Writer, s skipReport) {
+	for _, msg := range s.sample {
+		fmt.Fprintln(w, "Skipped:", msg)
+	}
+	if s.count > 0 {
+		fmt.Fprintf(w, "Skipped %d row(s)\n", s.count)
+	}
+}
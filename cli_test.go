@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReportSkipped(t *testing.T) {
+	tests := []struct {
+		s    skipReport
+		want string
+	}{
+		{skipReport{}, ""},
+		{skipReport{count: 12, sample: []string{"Line 3: bad", "Line 9: worse"}}, "Skipped: Line 3: bad\nSkipped: Line 9: worse\nSkipped 12 row(s)\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		reportSkipped(&buf, tt.s)
+		if buf.String() != tt.want {
+			t.Errorf("reportSkipped(%+v) wrote %q, want %q", tt.s, buf.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type config struct {
+	upstream string
+	addr     string
+
+	//Address the gRPC API listens on; empty disables it
+	grpcAddr string
+
+	//Required in X-API-Key or a bearer token when set; probes are exempt
+	apiKey string
+
+	//Origins allowed to call from a browser; * allows any, empty disables CORS
+	corsOrigins []string
+
+	//Requests per second allowed per client IP, 0 for no limit, and the burst
+	//a client may spend at once
+	rate  float64
+	burst int
+
+	//Certificate and key files; the server speaks HTTPS when both are set
+	tlsCert string
+	tlsKey  string
+
+	//Local zip, CSV or gzipped CSV read instead of fetching from upstream
+	file string
+
+	//Dataset GET /diff compares the cached one against
+	compareURL string
+
+	//Expected hex SHA-256 of the data file; a mismatch fails the load
+	checksum string
+
+	//Container of the data: zip, gzip, csv, or auto to sniff the leading bytes
+	archive string
+
+	//Field separator of the CSV
+	delimiter rune
+
+	//Whether the CSV starts with a header row: true, false, or auto to skip a
+	//first row whose range bounds are not integers
+	skipHeader string
+
+	//Directory keeping the last upstream download across restarts; empty
+	//disables it
+	cacheDir string
+
+	//Zip member holding the data; the first *.CSV is used if it is missing
+	csvName string
+
+	//Password for a ZipCrypto encrypted zip member
+	zipPassword string
+
+	//Load the dataset at startup instead of on the first request
+	eager bool
+
+	//Interval between background dataset reloads; 0 disables them
+	refresh time.Duration
+
+	//How long in-flight requests may run after SIGINT/SIGTERM
+	shutdownGrace time.Duration
+
+	//Deadline for handling one request, including waiting on a load; 0 for none
+	requestTimeout time.Duration
+
+	//CSV columns of each field, for products that lay them out differently
+	colFrom    int
+	colIP      int
+	colCountry int
+	colRegion  int
+	colCity    int
+
+	//CSV columns holding latitude and longitude; negative to ignore.
+	//IP2Location DB5 and later place them right after the city.
+	colLat int
+	colLon int
+
+	//Largest upstream download accepted, in bytes after any Content-Encoding
+	//is removed; 0 for no limit. Raise it for zip64 databases, which are over
+	//4GB; the download is spooled to disk, not memory.
+	maxDownload int64
+
+	//Upstream fetch retries: total attempts, and the delay before the first retry
+	//which doubles on each subsequent one
+	fetchAttempts int
+	fetchBackoff  time.Duration
+
+	//fetchTimeout bounds a whole attempt including reading the body, so a
+	//download still streaming when it fires fails that attempt (and is retried).
+	//dialTimeout only bounds establishing the TCP connection.
+	fetchTimeout time.Duration
+	dialTimeout  time.Duration
+
+	//Connection reuse between fetches. With a short -refresh, keep-alives let
+	//each poll skip the TCP and TLS handshakes; disable them if a proxy or
+	//load balancer drops idle connections without closing them. A 0
+	//idleConnTimeout keeps idle connections until the server closes them.
+	maxIdleConns      int
+	idleConnTimeout   time.Duration
+	disableKeepAlives bool
+
+	//Sent with every upstream request; empty sends no User-Agent at all
+	userAgent string
+
+	//Proxy for upstream requests; nil falls back to HTTP_PROXY, HTTPS_PROXY
+	//and NO_PROXY
+	proxy *url.URL
+
+	//Skip and count rows that fail to parse instead of failing the load
+	lenient bool
+
+	//Fail a load whose records are not strictly increasing by ToIP instead of
+	//sorting them afterwards
+	strictOrder bool
+
+	//Countries whose records are kept at all (allow) or dropped (deny) while
+	//parsing; nil keeps everything. At most one of them is set.
+	allow map[string]struct{}
+	deny  map[string]struct{}
+
+	//Keep region and city for every country, ignoring supportedCountries
+	allRegions bool
+
+	//Most IPs accepted by one /lookup/bulk request
+	bulkMax int
+
+	//Records /search returns when the request sets no limit
+	searchLimit int
+
+	//Structure answering lookups: binary search over the records, or a trie
+	//of IPv4 prefixes that is faster but uses more memory
+	lookupIndex string
+
+	//Database file written by the sqlite command
+	db string
+
+	//Loads allowed to run at once; further ones wait for a slot
+	maxParses int
+
+	//Goroutines parsing CSV rows; output order is preserved regardless
+	workers int
+
+	//Rows the reader may get ahead of the parser. Each buffered row pins its
+	//fields in memory; a small buffer stalls the reader on every handoff
+	//whenever the parser falls behind.
+	buffer int
+}
+
+//Defaults, overridden by parseFlags
+var cfg = config{
+	cacheDir:      defaultCacheDir(),
+	upstream:      "http://127.0.0.1:4000",
+	addr:          ":3000",
+	archive:       "auto",
+	skipHeader:    "auto",
+	delimiter:     ',',
+	csvName:       "IPV6-COUNTRY-REGION-CITY.CSV",
+	eager:         true,
+	shutdownGrace: 30 * time.Second,
+	colFrom:       0,
+	colIP:         1,
+	colCountry:    2,
+	colRegion:     4,
+	colCity:       5,
+	colLat:        6,
+	colLon:        7,
+	workers:       runtime.GOMAXPROCS(0),
+	buffer:        8192,
+	maxParses:     1,
+	fetchAttempts: 3,
+	fetchBackoff:  time.Second,
+	fetchTimeout:  180 * time.Second,
+	bulkMax:       10000,
+	searchLimit:   20,
+	lookupIndex:   "binary",
+	db:            "ip2loc.db",
+	burst:         20,
+	corsOrigins:   []string{"*"},
+	dialTimeout:   30 * time.Second,
+	userAgent:     "adsGO-csv-parser/1.0",
+	maxDownload:   512 << 20,
+
+	//As in http.DefaultTransport
+	maxIdleConns:    100,
+	idleConnTimeout: 90 * time.Second,
+}
+
+//Accepts http, https and socks5 proxies, the schemes http.Transport supports
+func setProxy(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Invalid proxy URL %q: must be an absolute URL such as http://proxy:3128", s)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("Invalid proxy URL %q: scheme must be http, https or socks5", s)
+	}
+	cfg.proxy = u
+	return nil
+}
+
+//The user cache directory, or the temp directory where there is none
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "adsgo-ip2loc")
+}
+
+//Environment variables consulted for flags not given on the command line
+var flagEnv = map[string]string{
+	"upstream":      "IP2LOC_UPSTREAM",
+	"addr":          "ADDR",
+	"fetch-timeout": "IP2LOC_FETCH_TIMEOUT",
+	"countries":     "IP2LOC_COUNTRIES",
+	"api-key":       "IP2LOC_API_KEY",
+	"zip-password":  "IP2LOC_ZIP_PASSWORD",
+}
+
+//Flags take precedence over environment variables, which take precedence over defaults
+func parseFlags(cmd string, args []string) error {
+	fs := flag.NewFlagSet("adsGO-csv-parser "+cmd, flag.ExitOnError)
+	fs.StringVar(&cfg.upstream, "upstream", cfg.upstream, "URL of the IP2Location upstream server (env IP2LOC_UPSTREAM)")
+	fs.StringVar(&cfg.file, "file", cfg.file, "Local IP2Location zip, CSV or .csv.gz to load instead of fetching from -upstream")
+	fs.StringVar(&cfg.compareURL, "compare-url", cfg.compareURL, "URL of a dataset GET /diff compares with the loaded one")
+	fs.StringVar(&cfg.checksum, "checksum", cfg.checksum, "Hex SHA-256 the downloaded or -file data must match; empty only logs the digest")
+	fs.StringVar(&cfg.cacheDir, "cache-dir", cfg.cacheDir, "Directory keeping the last download across restarts, empty to disable")
+	fs.BoolFunc("no-cache", "Disable the on-disk copy of the last download, same as -cache-dir=\"\"", func(string) error {
+		cfg.cacheDir = ""
+		return nil
+	})
+	fs.StringVar(&cfg.archive, "archive", cfg.archive, "Data container: zip, gzip, csv, or auto to detect it from the content")
+	fs.Func("delimiter", "Single character separating CSV fields, \\t for tab (default ,)", setDelimiter)
+	fs.StringVar(&cfg.skipHeader, "skip-header", cfg.skipHeader, "Skip the first CSV row: true, false, or auto to skip it only when it is not data")
+	fs.StringVar(&cfg.csvName, "csv-name", cfg.csvName, "Name of the CSV member inside the zip; falls back to the first *.CSV")
+	fs.StringVar(&cfg.zipPassword, "zip-password", cfg.zipPassword, "Password of a ZipCrypto encrypted zip (env IP2LOC_ZIP_PASSWORD)")
+	fs.StringVar(&cfg.addr, "addr", cfg.addr, "Address the HTTP server listens on (env ADDR)")
+	fs.StringVar(&cfg.grpcAddr, "grpc-addr", cfg.grpcAddr, "Address the gRPC API listens on, empty to disable")
+	fs.BoolVar(&cfg.eager, "eager", cfg.eager, "Load the dataset at startup, retrying until it succeeds; /ready reports when it is done")
+	fs.StringVar(&cfg.apiKey, "api-key", cfg.apiKey, "Key clients must send in X-API-Key or Authorization: Bearer; empty disables (env IP2LOC_API_KEY)")
+	fs.Func("cors-origins", "Comma-separated origins allowed by CORS, * for any, empty to disable (default *)", func(list string) error {
+		cfg.corsOrigins = splitOrigins(list)
+		return nil
+	})
+	fs.Float64Var(&cfg.rate, "rate", cfg.rate, "Requests per second allowed per client IP, 0 for no limit")
+	fs.IntVar(&cfg.burst, "burst", cfg.burst, "Requests a client may make at once before -rate applies")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", cfg.tlsCert, "PEM certificate file; serve HTTPS with -tls-key")
+	fs.StringVar(&cfg.tlsKey, "tls-key", cfg.tlsKey, "PEM private key file for -tls-cert")
+	fs.DurationVar(&cfg.refresh, "refresh", cfg.refresh, "Interval between background reloads of the dataset, 0 to disable")
+	fs.DurationVar(&cfg.shutdownGrace, "shutdown-grace", cfg.shutdownGrace, "Time allowed for in-flight requests to finish on shutdown")
+	fs.DurationVar(&cfg.requestTimeout, "request-timeout", cfg.requestTimeout, "Time limit for handling one request, answering 504 when it passes; 0 for none")
+	fs.IntVar(&cfg.colFrom, "col-from", cfg.colFrom, "CSV column index of the first IP of each range")
+	fs.IntVar(&cfg.colIP, "col-ip", cfg.colIP, "CSV column index of the last IP of each range")
+	fs.IntVar(&cfg.colCountry, "col-country", cfg.colCountry, "CSV column index of the country code")
+	fs.IntVar(&cfg.colRegion, "col-region", cfg.colRegion, "CSV column index of the region")
+	fs.IntVar(&cfg.colCity, "col-city", cfg.colCity, "CSV column index of the city")
+	fs.IntVar(&cfg.colLat, "col-lat", cfg.colLat, "CSV column index of the latitude, negative to ignore")
+	fs.IntVar(&cfg.colLon, "col-lon", cfg.colLon, "CSV column index of the longitude, negative to ignore")
+	fs.Int64Var(&cfg.maxDownload, "max-download", cfg.maxDownload, "Largest upstream download in bytes, 0 for no limit")
+	fs.IntVar(&cfg.fetchAttempts, "fetch-attempts", cfg.fetchAttempts, "Maximum upstream fetch attempts on connection errors and 5xx responses")
+	fs.DurationVar(&cfg.fetchBackoff, "fetch-backoff", cfg.fetchBackoff, "Base delay between fetch retries, doubled on each attempt")
+	fs.DurationVar(&cfg.fetchTimeout, "fetch-timeout", cfg.fetchTimeout, "Overall time limit for one upstream fetch attempt, including the download (env IP2LOC_FETCH_TIMEOUT)")
+	fs.DurationVar(&cfg.dialTimeout, "dial-timeout", cfg.dialTimeout, "Time limit for connecting to the upstream server")
+	fs.IntVar(&cfg.maxIdleConns, "max-idle-conns", cfg.maxIdleConns, "Idle upstream connections kept for reuse, 0 for no limit")
+	fs.DurationVar(&cfg.idleConnTimeout, "idle-conn-timeout", cfg.idleConnTimeout, "How long an idle upstream connection is kept, 0 for no limit")
+	fs.BoolVar(&cfg.disableKeepAlives, "disable-keepalives", cfg.disableKeepAlives, "Open a new upstream connection for every fetch instead of reusing one")
+	fs.StringVar(&cfg.userAgent, "user-agent", cfg.userAgent, "User-Agent header sent to the upstream server, empty to send none")
+	fs.Func("proxy", "Proxy URL for upstream requests, overriding HTTP_PROXY, HTTPS_PROXY and NO_PROXY", setProxy)
+	fs.Func("countries", "Comma-separated country codes whose records keep region and city (env IP2LOC_COUNTRIES, default AU,CA,GB,US)", setSupportedCountries)
+	fs.BoolVar(&cfg.lenient, "lenient", cfg.lenient, "Skip rows that fail to parse, reporting them in /stats, instead of failing the load")
+	fs.BoolVar(&cfg.strictOrder, "strict-order", cfg.strictOrder, "Reject data whose rows are not strictly increasing by range end instead of sorting it")
+	fs.Func("allow", "Comma-separated country codes to keep; records of other countries are dropped while parsing", func(list string) (err error) {
+		cfg.allow, err = countrySet(list)
+		return err
+	})
+	fs.Func("deny", "Comma-separated country codes whose records are dropped while parsing", func(list string) (err error) {
+		cfg.deny, err = countrySet(list)
+		return err
+	})
+	fs.BoolVar(&cfg.allRegions, "all-regions", cfg.allRegions, "Keep region and city for every country, ignoring -countries")
+	fs.IntVar(&cfg.bulkMax, "bulk-max", cfg.bulkMax, "Most IPs accepted by one /lookup/bulk request")
+	fs.IntVar(&cfg.searchLimit, "search-limit", cfg.searchLimit, "Records returned by /search without ?limit=")
+	fs.StringVar(&cfg.lookupIndex, "lookup-index", cfg.lookupIndex, "Lookup structure: binary, or trie for faster IPv4 lookups at several times the memory")
+	fs.IntVar(&cfg.maxParses, "max-parses", cfg.maxParses, "Loads allowed to run at once; each holds a full dataset in memory")
+	fs.IntVar(&cfg.workers, "workers", cfg.workers, "Number of goroutines parsing CSV rows")
+	fs.IntVar(&cfg.buffer, "buffer", cfg.buffer, "CSV rows buffered between reader and parser; larger uses more memory, smaller more handoffs")
+
+	if cmd == "sqlite" {
+		fs.StringVar(&cfg.db, "db", cfg.db, "SQLite database file to write the records to")
+	}
+
+	for name, key := range flagEnv {
+		if v := os.Getenv(key); v != "" {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("Invalid %s %q: %v", key, v, err)
+			}
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	upstreamSet := os.Getenv(flagEnv["upstream"]) != ""
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "upstream" {
+			upstreamSet = true
+		}
+	})
+
+	if _, ok := archiveKinds[cfg.archive]; !ok {
+		return fmt.Errorf("Invalid archive %q: must be auto, zip, gzip or csv", cfg.archive)
+	}
+	if _, ok := lookupIndexes[cfg.lookupIndex]; !ok {
+		return fmt.Errorf("Invalid lookup-index %q: must be binary or trie", cfg.lookupIndex)
+	}
+	if b, err := hex.DecodeString(cfg.checksum); err != nil || (cfg.checksum != "" && len(b) != sha256.Size) {
+		return fmt.Errorf("Invalid checksum %q: must be %d hex digits", cfg.checksum, 2*sha256.Size)
+	}
+	if cfg.skipHeader != "auto" && cfg.skipHeader != "true" && cfg.skipHeader != "false" {
+		return fmt.Errorf("Invalid skip-header %q: must be auto, true or false", cfg.skipHeader)
+	}
+	for name, col := range map[string]int{"col-from": cfg.colFrom, "col-ip": cfg.colIP, "col-country": cfg.colCountry, "col-region": cfg.colRegion, "col-city": cfg.colCity} {
+		if col < 0 {
+			return fmt.Errorf("Invalid %s %d: must not be negative", name, col)
+		}
+	}
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if cfg.allow != nil && cfg.deny != nil {
+		return fmt.Errorf("-allow and -deny are mutually exclusive")
+	}
+	if cfg.searchLimit < 1 {
+		return fmt.Errorf("Invalid search-limit %d: must be at least 1", cfg.searchLimit)
+	}
+	if cfg.maxParses < 1 {
+		return fmt.Errorf("Invalid max-parses %d: must be at least 1", cfg.maxParses)
+	}
+	if cfg.workers < 1 {
+		return fmt.Errorf("Invalid workers %d: must be at least 1", cfg.workers)
+	}
+	if cfg.rate < 0 || cfg.burst < 1 {
+		return fmt.Errorf("Invalid rate %g or burst %d: rate must not be negative and burst must be at least 1", cfg.rate, cfg.burst)
+	}
+	if cfg.maxDownload < 0 {
+		return fmt.Errorf("Invalid max-download %d: must not be negative", cfg.maxDownload)
+	}
+	if cfg.buffer < 0 {
+		return fmt.Errorf("Invalid buffer %d: must not be negative", cfg.buffer)
+	}
+	if cfg.fetchAttempts < 1 {
+		return fmt.Errorf("Invalid fetch-attempts %d: must be at least 1", cfg.fetchAttempts)
+	}
+	if cfg.fetchBackoff < 0 {
+		return fmt.Errorf("Invalid fetch-backoff %s: must not be negative", cfg.fetchBackoff)
+	}
+	if cfg.fetchTimeout < 0 || cfg.dialTimeout < 0 {
+		return fmt.Errorf("Invalid fetch-timeout %s or dial-timeout %s: must not be negative", cfg.fetchTimeout, cfg.dialTimeout)
+	}
+	if cfg.maxIdleConns < 0 || cfg.idleConnTimeout < 0 {
+		return fmt.Errorf("Invalid max-idle-conns %d or idle-conn-timeout %s: must not be negative", cfg.maxIdleConns, cfg.idleConnTimeout)
+	}
+	if cfg.requestTimeout < 0 {
+		return fmt.Errorf("Invalid request-timeout %s: must not be negative", cfg.requestTimeout)
+	}
+	if cfg.refresh < 0 {
+		return fmt.Errorf("Invalid refresh interval %s: must not be negative", cfg.refresh)
+	}
+
+	if cfg.file != "" {
+		if upstreamSet {
+			return fmt.Errorf("-file and -upstream are mutually exclusive")
+		}
+		return nil
+	}
+
+	u, err := url.ParseRequestURI(cfg.upstream)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("Invalid upstream URL %q: must be an absolute URL such as http://host:port", cfg.upstream)
+	}
+	return nil
+}
+
+//Sets cfg.delimiter from a one-character string, or \t for a tab
+func setDelimiter(s string) error {
+	if s == `\t` {
+		s = "\t"
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) || r == utf8.RuneError {
+		return fmt.Errorf("Delimiter must be exactly one character, got %q", s)
+	}
+	if r == '"' || r == '\r' || r == '\n' {
+		return fmt.Errorf("Delimiter %q cannot be a quote or line break", r)
+	}
+	cfg.delimiter = r
+	return nil
+}
+
+//Replaces supportedCountries with the comma-separated codes in list
+func setSupportedCountries(list string) error {
+	set, err := countrySet(list)
+	if err != nil {
+		return err
+	}
+	supportedMu.Lock()
+	supportedCountries = set
+	supportedMu.Unlock()
+	return nil
+}
+
+//Comma-separated country codes as an upper-case set
+func countrySet(list string) (map[string]struct{}, error) {
+	set := make(map[string]struct{})
+	for _, c := range strings.Split(list, ",") {
+		code := strings.ToUpper(strings.TrimSpace(c))
+		if code == "" {
+			continue
+		}
+		if _, ok := isoCountries[code]; !ok {
+			return nil, fmt.Errorf("Unknown country code %q", c)
+		}
+		set[code] = struct{}{}
+	}
+	return set, nil
+}
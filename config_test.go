@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+//-countries and IP2LOC_COUNTRIES decide which records keep region and city
+func TestCountriesFlag(t *testing.T) {
+	de := []string{"1", "2", "DE", "Germany", "Berlin", "Berlin"}
+	us := []string{"3", "4", "US", "United States of America", "California", "Los Angeles"}
+	tests := []struct {
+		name     string
+		args     []string
+		env      string
+		regionDE bool
+		regionUS bool
+	}{
+		{"default", nil, "", false, true},
+		{"flag adds DE and drops US", []string{"-countries", "au,ca,gb,de"}, "", true, false},
+		{"env", nil, " de , US ", true, true},
+		{"flag over env", []string{"-countries", "US"}, "DE", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepConfig(t)
+			keepSupported(t)
+			t.Setenv("IP2LOC_COUNTRIES", tt.env)
+			if err := parseFlags("serve", tt.args); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				row  []string
+				want bool
+			}{{de, tt.regionDE}, {us, tt.regionUS}} {
+				rec, ok, err := parseRow(c.row)
+				if err != nil || !ok {
+					t.Fatalf("parseRow(%q) = %v, %v", c.row, ok, err)
+				}
+				if got := rec.Region != "" && rec.City != ""; got != c.want {
+					t.Errorf("%s record has region %q and city %q; want them kept: %v", c.row[2], rec.Region, rec.City, c.want)
+				}
+			}
+		})
+	}
+	keepSupported(t)
+	if err := setSupportedCountries("US,XX"); err == nil {
+		t.Error("Accepted an unknown country code")
+	}
+}
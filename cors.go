@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+	corsHeaders = "Accept, Authorization, Content-Type, If-None-Match, X-API-Key"
+	//Response headers browsers hide from scripts unless listed
+	corsExpose = "ETag, Recs-Length, Recs-Total, Retry-After, X-Dataset-Date, X-Request-Id"
+)
+
+//Adds CORS headers for origins in -cors-origins and answers preflights
+//itself, so they never need an API key or count against the rate limit
+func cors(h http.Handler) http.Handler {
+	if len(cfg.corsOrigins) == 0 {
+		return h
+	}
+	wildcard := false
+	allowed := make(map[string]struct{})
+	for _, o := range cfg.corsOrigins {
+		if o == "*" {
+			wildcard = true
+		}
+		allowed[o] = struct{}{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		_, ok := allowed[origin]
+		if !wildcard && !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if wildcard {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExpose)
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//Comma-separated origins, dropping blanks
+func splitOrigins(list string) []string {
+	var origins []string
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
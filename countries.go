@@ -0,0 +1,510 @@
+package main
+
+//ISO 3166-1 alpha-2 codes and English short names, plus XK which IP2Location
+//uses for Kosovo
+var isoCountries = map[string]string{
+	"AD": "Andorra",
+	"AE": "United Arab Emirates",
+	"AF": "Afghanistan",
+	"AG": "Antigua and Barbuda",
+	"AI": "Anguilla",
+	"AL": "Albania",
+	"AM": "Armenia",
+	"AO": "Angola",
+	"AQ": "Antarctica",
+	"AR": "Argentina",
+	"AS": "American Samoa",
+	"AT": "Austria",
+	"AU": "Australia",
+	"AW": "Aruba",
+	"AX": "Åland Islands",
+	"AZ": "Azerbaijan",
+	"BA": "Bosnia and Herzegovina",
+	"BB": "Barbados",
+	"BD": "Bangladesh",
+	"BE": "Belgium",
+	"BF": "Burkina Faso",
+	"BG": "Bulgaria",
+	"BH": "Bahrain",
+	"BI": "Burundi",
+	"BJ": "Benin",
+	"BL": "Saint Barthélemy",
+	"BM": "Bermuda",
+	"BN": "Brunei Darussalam",
+	"BO": "Bolivia",
+	"BQ": "Bonaire, Sint Eustatius and Saba",
+	"BR": "Brazil",
+	"BS": "Bahamas",
+	"BT": "Bhutan",
+	"BV": "Bouvet Island",
+	"BW": "Botswana",
+	"BY": "Belarus",
+	"BZ": "Belize",
+	"CA": "Canada",
+	"CC": "Cocos (Keeling) Islands",
+	"CD": "Congo, The Democratic Republic of the",
+	"CF": "Central African Republic",
+	"CG": "Congo",
+	"CH": "Switzerland",
+	"CI": "Côte d'Ivoire",
+	"CK": "Cook Islands",
+	"CL": "Chile",
+	"CM": "Cameroon",
+	"CN": "China",
+	"CO": "Colombia",
+	"CR": "Costa Rica",
+	"CU": "Cuba",
+	"CV": "Cabo Verde",
+	"CW": "Curaçao",
+	"CX": "Christmas Island",
+	"CY": "Cyprus",
+	"CZ": "Czechia",
+	"DE": "Germany",
+	"DJ": "Djibouti",
+	"DK": "Denmark",
+	"DM": "Dominica",
+	"DO": "Dominican Republic",
+	"DZ": "Algeria",
+	"EC": "Ecuador",
+	"EE": "Estonia",
+	"EG": "Egypt",
+	"EH": "Western Sahara",
+	"ER": "Eritrea",
+	"ES": "Spain",
+	"ET": "Ethiopia",
+	"FI": "Finland",
+	"FJ": "Fiji",
+	"FK": "Falkland Islands (Malvinas)",
+	"FM": "Micronesia, Federated States of",
+	"FO": "Faroe Islands",
+	"FR": "France",
+	"GA": "Gabon",
+	"GB": "United Kingdom",
+	"GD": "Grenada",
+	"GE": "Georgia",
+	"GF": "French Guiana",
+	"GG": "Guernsey",
+	"GH": "Ghana",
+	"GI": "Gibraltar",
+	"GL": "Greenland",
+	"GM": "Gambia",
+	"GN": "Guinea",
+	"GP": "Guadeloupe",
+	"GQ": "Equatorial Guinea",
+	"GR": "Greece",
+	"GS": "South Georgia and the South Sandwich Islands",
+	"GT": "Guatemala",
+	"GU": "Guam",
+	"GW": "Guinea-Bissau",
+	"GY": "Guyana",
+	"HK": "Hong Kong",
+	"HM": "Heard Island and McDonald Islands",
+	"HN": "Honduras",
+	"HR": "Croatia",
+	"HT": "Haiti",
+	"HU": "Hungary",
+	"ID": "Indonesia",
+	"IE": "Ireland",
+	"IL": "Israel",
+	"IM": "Isle of Man",
+	"IN": "India",
+	"IO": "British Indian Ocean Territory",
+	"IQ": "Iraq",
+	"IR": "Iran",
+	"IS": "Iceland",
+	"IT": "Italy",
+	"JE": "Jersey",
+	"JM": "Jamaica",
+	"JO": "Jordan",
+	"JP": "Japan",
+	"KE": "Kenya",
+	"KG": "Kyrgyzstan",
+	"KH": "Cambodia",
+	"KI": "Kiribati",
+	"KM": "Comoros",
+	"KN": "Saint Kitts and Nevis",
+	"KP": "North Korea",
+	"KR": "South Korea",
+	"KW": "Kuwait",
+	"KY": "Cayman Islands",
+	"KZ": "Kazakhstan",
+	"LA": "Laos",
+	"LB": "Lebanon",
+	"LC": "Saint Lucia",
+	"LI": "Liechtenstein",
+	"LK": "Sri Lanka",
+	"LR": "Liberia",
+	"LS": "Lesotho",
+	"LT": "Lithuania",
+	"LU": "Luxembourg",
+	"LV": "Latvia",
+	"LY": "Libya",
+	"MA": "Morocco",
+	"MC": "Monaco",
+	"MD": "Moldova",
+	"ME": "Montenegro",
+	"MF": "Saint Martin (French part)",
+	"MG": "Madagascar",
+	"MH": "Marshall Islands",
+	"MK": "North Macedonia",
+	"ML": "Mali",
+	"MM": "Myanmar",
+	"MN": "Mongolia",
+	"MO": "Macao",
+	"MP": "Northern Mariana Islands",
+	"MQ": "Martinique",
+	"MR": "Mauritania",
+	"MS": "Montserrat",
+	"MT": "Malta",
+	"MU": "Mauritius",
+	"MV": "Maldives",
+	"MW": "Malawi",
+	"MX": "Mexico",
+	"MY": "Malaysia",
+	"MZ": "Mozambique",
+	"NA": "Namibia",
+	"NC": "New Caledonia",
+	"NE": "Niger",
+	"NF": "Norfolk Island",
+	"NG": "Nigeria",
+	"NI": "Nicaragua",
+	"NL": "Netherlands",
+	"NO": "Norway",
+	"NP": "Nepal",
+	"NR": "Nauru",
+	"NU": "Niue",
+	"NZ": "New Zealand",
+	"OM": "Oman",
+	"PA": "Panama",
+	"PE": "Peru",
+	"PF": "French Polynesia",
+	"PG": "Papua New Guinea",
+	"PH": "Philippines",
+	"PK": "Pakistan",
+	"PL": "Poland",
+	"PM": "Saint Pierre and Miquelon",
+	"PN": "Pitcairn",
+	"PR": "Puerto Rico",
+	"PS": "Palestine, State of",
+	"PT": "Portugal",
+	"PW": "Palau",
+	"PY": "Paraguay",
+	"QA": "Qatar",
+	"RE": "Réunion",
+	"RO": "Romania",
+	"RS": "Serbia",
+	"RU": "Russian Federation",
+	"RW": "Rwanda",
+	"SA": "Saudi Arabia",
+	"SB": "Solomon Islands",
+	"SC": "Seychelles",
+	"SD": "Sudan",
+	"SE": "Sweden",
+	"SG": "Singapore",
+	"SH": "Saint Helena, Ascension and Tristan da Cunha",
+	"SI": "Slovenia",
+	"SJ": "Svalbard and Jan Mayen",
+	"SK": "Slovakia",
+	"SL": "Sierra Leone",
+	"SM": "San Marino",
+	"SN": "Senegal",
+	"SO": "Somalia",
+	"SR": "Suriname",
+	"SS": "South Sudan",
+	"ST": "Sao Tome and Principe",
+	"SV": "El Salvador",
+	"SX": "Sint Maarten (Dutch part)",
+	"SY": "Syria",
+	"SZ": "Eswatini",
+	"TC": "Turks and Caicos Islands",
+	"TD": "Chad",
+	"TF": "French Southern Territories",
+	"TG": "Togo",
+	"TH": "Thailand",
+	"TJ": "Tajikistan",
+	"TK": "Tokelau",
+	"TL": "Timor-Leste",
+	"TM": "Turkmenistan",
+	"TN": "Tunisia",
+	"TO": "Tonga",
+	"TR": "Türkiye",
+	"TT": "Trinidad and Tobago",
+	"TV": "Tuvalu",
+	"TW": "Taiwan",
+	"TZ": "Tanzania",
+	"UA": "Ukraine",
+	"UG": "Uganda",
+	"UM": "United States Minor Outlying Islands",
+	"US": "United States",
+	"UY": "Uruguay",
+	"UZ": "Uzbekistan",
+	"VA": "Holy See (Vatican City State)",
+	"VC": "Saint Vincent and the Grenadines",
+	"VE": "Venezuela",
+	"VG": "Virgin Islands, British",
+	"VI": "Virgin Islands, U.S.",
+	"VN": "Vietnam",
+	"VU": "Vanuatu",
+	"WF": "Wallis and Futuna",
+	"WS": "Samoa",
+	"YE": "Yemen",
+	"YT": "Mayotte",
+	"ZA": "South Africa",
+	"ZM": "Zambia",
+	"ZW": "Zimbabwe",
+	"XK": "Kosovo",
+}
+
+//Continent of each code in isoCountries
+var continents = map[string]string{
+	"AD": "Europe",
+	"AE": "Asia",
+	"AF": "Asia",
+	"AG": "North America",
+	"AI": "North America",
+	"AL": "Europe",
+	"AM": "Asia",
+	"AO": "Africa",
+	"AQ": "Antarctica",
+	"AR": "South America",
+	"AS": "Oceania",
+	"AT": "Europe",
+	"AU": "Oceania",
+	"AW": "North America",
+	"AX": "Europe",
+	"AZ": "Asia",
+	"BA": "Europe",
+	"BB": "North America",
+	"BD": "Asia",
+	"BE": "Europe",
+	"BF": "Africa",
+	"BG": "Europe",
+	"BH": "Asia",
+	"BI": "Africa",
+	"BJ": "Africa",
+	"BL": "North America",
+	"BM": "North America",
+	"BN": "Asia",
+	"BO": "South America",
+	"BQ": "North America",
+	"BR": "South America",
+	"BS": "North America",
+	"BT": "Asia",
+	"BV": "Antarctica",
+	"BW": "Africa",
+	"BY": "Europe",
+	"BZ": "North America",
+	"CA": "North America",
+	"CC": "Asia",
+	"CD": "Africa",
+	"CF": "Africa",
+	"CG": "Africa",
+	"CH": "Europe",
+	"CI": "Africa",
+	"CK": "Oceania",
+	"CL": "South America",
+	"CM": "Africa",
+	"CN": "Asia",
+	"CO": "South America",
+	"CR": "North America",
+	"CU": "North America",
+	"CV": "Africa",
+	"CW": "North America",
+	"CX": "Asia",
+	"CY": "Asia",
+	"CZ": "Europe",
+	"DE": "Europe",
+	"DJ": "Africa",
+	"DK": "Europe",
+	"DM": "North America",
+	"DO": "North America",
+	"DZ": "Africa",
+	"EC": "South America",
+	"EE": "Europe",
+	"EG": "Africa",
+	"EH": "Africa",
+	"ER": "Africa",
+	"ES": "Europe",
+	"ET": "Africa",
+	"FI": "Europe",
+	"FJ": "Oceania",
+	"FK": "South America",
+	"FM": "Oceania",
+	"FO": "Europe",
+	"FR": "Europe",
+	"GA": "Africa",
+	"GB": "Europe",
+	"GD": "North America",
+	"GE": "Asia",
+	"GF": "South America",
+	"GG": "Europe",
+	"GH": "Africa",
+	"GI": "Europe",
+	"GL": "North America",
+	"GM": "Africa",
+	"GN": "Africa",
+	"GP": "North America",
+	"GQ": "Africa",
+	"GR": "Europe",
+	"GS": "Antarctica",
+	"GT": "North America",
+	"GU": "Oceania",
+	"GW": "Africa",
+	"GY": "South America",
+	"HK": "Asia",
+	"HM": "Antarctica",
+	"HN": "North America",
+	"HR": "Europe",
+	"HT": "North America",
+	"HU": "Europe",
+	"ID": "Asia",
+	"IE": "Europe",
+	"IL": "Asia",
+	"IM": "Europe",
+	"IN": "Asia",
+	"IO": "Africa",
+	"IQ": "Asia",
+	"IR": "Asia",
+	"IS": "Europe",
+	"IT": "Europe",
+	"JE": "Europe",
+	"JM": "North America",
+	"JO": "Asia",
+	"JP": "Asia",
+	"KE": "Africa",
+	"KG": "Asia",
+	"KH": "Asia",
+	"KI": "Oceania",
+	"KM": "Africa",
+	"KN": "North America",
+	"KP": "Asia",
+	"KR": "Asia",
+	"KW": "Asia",
+	"KY": "North America",
+	"KZ": "Asia",
+	"LA": "Asia",
+	"LB": "Asia",
+	"LC": "North America",
+	"LI": "Europe",
+	"LK": "Asia",
+	"LR": "Africa",
+	"LS": "Africa",
+	"LT": "Europe",
+	"LU": "Europe",
+	"LV": "Europe",
+	"LY": "Africa",
+	"MA": "Africa",
+	"MC": "Europe",
+	"MD": "Europe",
+	"ME": "Europe",
+	"MF": "North America",
+	"MG": "Africa",
+	"MH": "Oceania",
+	"MK": "Europe",
+	"ML": "Africa",
+	"MM": "Asia",
+	"MN": "Asia",
+	"MO": "Asia",
+	"MP": "Oceania",
+	"MQ": "North America",
+	"MR": "Africa",
+	"MS": "North America",
+	"MT": "Europe",
+	"MU": "Africa",
+	"MV": "Asia",
+	"MW": "Africa",
+	"MX": "North America",
+	"MY": "Asia",
+	"MZ": "Africa",
+	"NA": "Africa",
+	"NC": "Oceania",
+	"NE": "Africa",
+	"NF": "Oceania",
+	"NG": "Africa",
+	"NI": "North America",
+	"NL": "Europe",
+	"NO": "Europe",
+	"NP": "Asia",
+	"NR": "Oceania",
+	"NU": "Oceania",
+	"NZ": "Oceania",
+	"OM": "Asia",
+	"PA": "North America",
+	"PE": "South America",
+	"PF": "Oceania",
+	"PG": "Oceania",
+	"PH": "Asia",
+	"PK": "Asia",
+	"PL": "Europe",
+	"PM": "North America",
+	"PN": "Oceania",
+	"PR": "North America",
+	"PS": "Asia",
+	"PT": "Europe",
+	"PW": "Oceania",
+	"PY": "South America",
+	"QA": "Asia",
+	"RE": "Africa",
+	"RO": "Europe",
+	"RS": "Europe",
+	"RU": "Europe",
+	"RW": "Africa",
+	"SA": "Asia",
+	"SB": "Oceania",
+	"SC": "Africa",
+	"SD": "Africa",
+	"SE": "Europe",
+	"SG": "Asia",
+	"SH": "Africa",
+	"SI": "Europe",
+	"SJ": "Europe",
+	"SK": "Europe",
+	"SL": "Africa",
+	"SM": "Europe",
+	"SN": "Africa",
+	"SO": "Africa",
+	"SR": "South America",
+	"SS": "Africa",
+	"ST": "Africa",
+	"SV": "North America",
+	"SX": "North America",
+	"SY": "Asia",
+	"SZ": "Africa",
+	"TC": "North America",
+	"TD": "Africa",
+	"TF": "Antarctica",
+	"TG": "Africa",
+	"TH": "Asia",
+	"TJ": "Asia",
+	"TK": "Oceania",
+	"TL": "Asia",
+	"TM": "Asia",
+	"TN": "Africa",
+	"TO": "Oceania",
+	"TR": "Asia",
+	"TT": "North America",
+	"TV": "Oceania",
+	"TW": "Asia",
+	"TZ": "Africa",
+	"UA": "Europe",
+	"UG": "Africa",
+	"UM": "North America",
+	"US": "North America",
+	"UY": "South America",
+	"UZ": "Asia",
+	"VA": "Europe",
+	"VC": "North America",
+	"VE": "South America",
+	"VG": "North America",
+	"VI": "North America",
+	"VN": "Asia",
+	"VU": "Oceania",
+	"WF": "Oceania",
+	"WS": "Oceania",
+	"XK": "Europe",
+	"YE": "Asia",
+	"YT": "Africa",
+	"ZA": "Africa",
+	"ZM": "Africa",
+	"ZW": "Africa",
+}
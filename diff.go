@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+)
+
+//Records of each kind listed in a /diff response; the rest are only counted
+const diffSampleSize = 20
+
+//A range present in both datasets whose data differs
+type rangeChange struct {
+	Before *ip2locRec `json:"before"`
+	After  *ip2locRec `json:"after"`
+}
+
+type diffSummary struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+
+	AddedSample   []*ip2locRec  `json:"addedSample,omitempty"`
+	RemovedSample []*ip2locRec  `json:"removedSample,omitempty"`
+	ChangedSample []rangeChange `json:"changedSample,omitempty"`
+}
+
+func (s *diffSummary) added(rec ip2locRec) {
+	s.Added++
+	if len(s.AddedSample) < diffSampleSize {
+		s.AddedSample = append(s.AddedSample, &rec)
+	}
+}
+
+func (s *diffSummary) removed(rec *ip2locRec) {
+	s.Removed++
+	if len(s.RemovedSample) < diffSampleSize {
+		s.RemovedSample = append(s.RemovedSample, rec)
+	}
+}
+
+func (s *diffSummary) changed(before *ip2locRec, after ip2locRec) {
+	s.Changed++
+	if len(s.ChangedSample) < diffSampleSize {
+		s.ChangedSample = append(s.ChangedSample, rangeChange{before, &after})
+	}
+}
+
+//Ranges are keyed by [FromIP, ToIP] and ordered by ToIP, then FromIP
+func compareRanges(a, b *ip2locRec) int {
+	if c := a.ToIP.Cmp(&b.ToIP); c != 0 {
+		return c
+	}
+	return a.FromIP.Cmp(&b.FromIP)
+}
+
+func sameData(a, b *ip2locRec) bool {
+	return a.CountryCode == b.CountryCode && a.Region == b.Region && a.City == b.City &&
+		a.Latitude == b.Latitude && a.Longitude == b.Longitude
+}
+
+//Ranges added, removed and changed going from the cached dataset to another
+//one: GET compares with -compare-url, POST with a zip, CSV or .csv.gz in the
+//body. The other dataset is merged against the cache as it is parsed rather
+//than held in memory, so it must be ordered by range end like IP2Location's.
+func ip2locDiff(w http.ResponseWriter, r *http.Request) *appError {
+	var open sourceFunc
+	switch r.Method {
+	case "GET":
+		if cfg.compareURL == "" {
+			return &appError{errors.New("No -compare-url"), "No -compare-url is set; POST the dataset to compare instead", 400}
+		}
+		open = func(ctx context.Context, _ validators) (*dataFile, error) {
+			return fetch(ctx, cfg.compareURL, validators{})
+		}
+	case "POST":
+		upload, e := spoolUpload(w, r)
+		if e != nil {
+			return e
+		}
+		//The load closes the file once it has it; this covers failing before then
+		defer func() {
+			if upload != nil {
+				upload.Close()
+			}
+		}()
+		open = func(context.Context, validators) (*dataFile, error) {
+			d := upload
+			upload = nil
+			return d, nil
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return &appError{fmt.Errorf("Method %s not allowed", r.Method), "Diff requires GET or POST", 405}
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+	recs := view.recs
+	//Cached records are sorted by ToIP alone; only ranges sharing an end, which
+	//overlapping data can have, need the FromIP tiebreak
+	order := make([]int, len(recs))
+	for i := range order {
+		order[i] = i
+	}
+	less := func(a, b int) bool { return compareRanges(&recs[order[a]], &recs[order[b]]) < 0 }
+	if !sort.SliceIsSorted(order, less) {
+		sort.SliceStable(order, less)
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var sum diffSummary
+	var prev ip2locRec
+	var orderErr error
+	k, seen := 0, false
+	//Not reported on /progress, which follows the cached dataset
+	_, e := loadFrom(ctx, open, nil, validators{}, func(rec *ip2locRec) {
+		if orderErr != nil {
+			return
+		}
+		if seen && compareRanges(rec, &prev) <= 0 {
+			orderErr = fmt.Errorf("Range ending at %s does not follow %s", rec.ToIP.String(), prev.ToIP.String())
+			cancel()
+			return
+		}
+		prev, seen = *rec, true
+		for ; k < len(order) && compareRanges(&recs[order[k]], rec) < 0; k++ {
+			sum.removed(&recs[order[k]])
+		}
+		if k < len(order) && compareRanges(&recs[order[k]], rec) == 0 {
+			if sameData(&recs[order[k]], rec) {
+				sum.Unchanged++
+			} else {
+				sum.changed(&recs[order[k]], *rec)
+			}
+			k++
+			return
+		}
+		sum.added(*rec)
+	})
+	if orderErr != nil {
+		return &appError{orderErr, "Dataset to compare is not ordered by range end", 400}
+	}
+	if e != nil {
+		return e
+	}
+	for ; k < len(order); k++ {
+		sum.removed(&recs[order[k]])
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(&sum); err != nil {
+		return &appError{err, "Error marshalling diff", 500}
+	}
+	return nil
+}
+
+//The request body in a temporary file, as the zip reader needs random access
+func spoolUpload(w http.ResponseWriter, r *http.Request) (*dataFile, *appError) {
+	var body io.Reader = r.Body
+	if cfg.maxDownload > 0 {
+		body = http.MaxBytesReader(w, r.Body, cfg.maxDownload)
+	}
+	f, err := os.CreateTemp("", "ip2loc-diff-*")
+	if err != nil {
+		return nil, &appError{err, "Error storing uploaded dataset", 500}
+	}
+	d := &dataFile{File: f, temp: true}
+	if d.size, err = io.Copy(f, body); err != nil {
+		d.Close()
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			return nil, &appError{err, fmt.Sprintf("Uploaded dataset exceeds -max-download of %d bytes", cfg.maxDownload), 413}
+		}
+		return nil, &appError{err, "Error reading uploaded dataset", 400}
+	}
+	return d, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Comparing with an uploaded dataset reports what it changes, without showing
+//its parse on /progress as if it were a refresh
+func TestDiffUpload(t *testing.T) {
+	useTestData(t)
+	if _, e := cache.get(t.Context()); e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	last := progress.result()
+
+	upload := strings.Replace(testCSV, "Los Angeles", "San Diego", 1) +
+		`"16779264","16781311","CN","China","Guangdong","Guangzhou"` + "\n"
+	r := httptest.NewRequest("POST", "/diff", strings.NewReader(upload))
+	rr := serveRequest(appHandler(ip2locDiff), r)
+	if rr.Code != 200 {
+		t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+	}
+	var sum diffSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum.Added != 1 || sum.Removed != 0 || sum.Changed != 1 || sum.Unchanged != 2 {
+		t.Errorf("Diff %+v, want 1 added, 1 changed and 2 unchanged", sum)
+	}
+
+	progress.mu.Lock()
+	active := progress.active
+	progress.mu.Unlock()
+	if got := progress.result(); active || got != last {
+		t.Errorf("Progress %+v (active %v) after the diff, want %+v", got, active, last)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//Stored next to the cached download and checked before it is trusted
+type diskMeta struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+	SHA256       string `json:"sha256"`
+	Size         int64  `json:"size"`
+}
+
+func diskCachePaths() (data, meta string) {
+	return filepath.Join(cfg.cacheDir, "dataset.bin"), filepath.Join(cfg.cacheDir, "dataset.json")
+}
+
+//Like fetch, keeping the last download in -cache-dir. On a cold start the
+//copy's validators are sent upstream, so an unchanged dataset is read from
+//disk rather than downloaded again; the copy is also used if upstream fails.
+func fetchCached(ctx context.Context, url string, cond validators) (*dataFile, error) {
+	var disk *dataFile
+	if cond == (validators{}) {
+		var err error
+		if disk, err = loadDiskCache(); err != nil && !os.IsNotExist(err) {
+			log.Printf("Ignoring cached dataset: %v", err)
+		}
+		if disk != nil {
+			cond = disk.validators
+		}
+	}
+
+	d, err := fetch(ctx, url, cond)
+	//openSource checks the result too, but a bad download must not replace
+	//the copy on disk
+	if err == nil {
+		if err = matchChecksum(d.sha256); err != nil {
+			d.Close()
+		}
+	}
+	switch {
+	case err == nil:
+		if disk != nil {
+			disk.Close()
+		}
+		if err := saveDiskCache(d); err != nil {
+			log.Printf("Error caching dataset on disk: %v", err)
+		}
+		return d, nil
+	case disk != nil && err == errNotModified:
+		log.Print("Upstream dataset unchanged, reading cached copy from disk")
+		return disk, nil
+	case disk != nil && ctx.Err() == nil:
+		log.Printf("Fetch failed, reading cached copy from disk: %v", err)
+		return disk, nil
+	}
+	if disk != nil {
+		disk.Close()
+	}
+	return nil, err
+}
+
+//The cached download, if its checksum still matches
+func loadDiskCache() (*dataFile, error) {
+	dataPath, metaPath := diskCachePaths()
+	b, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", metaPath, err)
+	}
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n != meta.Size || hex.EncodeToString(h.Sum(nil)) != meta.SHA256 {
+		f.Close()
+		return nil, fmt.Errorf("Checksum mismatch for %s", dataPath)
+	}
+	return &dataFile{File: f, size: n, sha256: meta.SHA256, validators: validators{meta.ETag, meta.LastModified}}, nil
+}
+
+//Copy d into the cache directory. Both files are written under temporary
+//names and renamed, so a crash never leaves a half-written cache that looks valid.
+func saveDiskCache(d *dataFile) error {
+	if err := os.MkdirAll(cfg.cacheDir, 0o755); err != nil {
+		return err
+	}
+	dataPath, metaPath := diskCachePaths()
+
+	tmp, err := os.CreateTemp(cfg.cacheDir, "dataset-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.NewSectionReader(d, 0, d.size))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(diskMeta{d.validators.etag, d.validators.lastModified, hex.EncodeToString(h.Sum(nil)), n})
+	if err != nil {
+		return err
+	}
+	//Remove the old metadata first: between the renames the data and its
+	//checksum disagree, and loadDiskCache rejects that
+	os.Remove(metaPath)
+	if err := os.Rename(tmp.Name(), dataPath); err != nil {
+		return err
+	}
+	metaTmp := metaPath + ".tmp"
+	if err := os.WriteFile(metaTmp, meta, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(metaTmp, metaPath)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Fields /distinct can list, with how to read each from a record
+var distinctFields = map[string]func(*ip2locRec) string{
+	"country": func(rec *ip2locRec) string { return strings.ToUpper(rec.CountryCode) },
+	"region":  func(rec *ip2locRec) string { return rec.Region },
+	"city":    func(rec *ip2locRec) string { return rec.City },
+}
+
+//Answers computed for one dataset version, dropped once a refresh replaces it
+type distinctCache struct {
+	mu       sync.Mutex
+	loadedAt time.Time
+	values   map[string][]string
+}
+
+var distinctValues = &distinctCache{}
+
+//Answers kept per dataset version. Every filter combination is its own key,
+//so without a bound clients could grow it without limit. Once full it is
+//emptied, and the answers still in demand soon fill it again.
+const distinctCacheSize = 256
+
+func (c *distinctCache) get(loadedAt time.Time, key string, compute func() []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.loadedAt.Equal(loadedAt) {
+		c.loadedAt, c.values = loadedAt, make(map[string][]string)
+	}
+	v, ok := c.values[key]
+	if !ok {
+		v = compute()
+		if len(c.values) >= distinctCacheSize {
+			c.values = make(map[string][]string)
+		}
+		c.values[key] = v
+	}
+	return v
+}
+
+//Sorted unique non-empty values of ?field= for dropdowns, among the records
+//the dump's filters select, so cities can be listed for a chosen region.
+//Regions and cities are only kept for supported countries.
+func ip2locDistinct(w http.ResponseWriter, r *http.Request) *appError {
+	q := r.URL.Query()
+	field := q.Get("field")
+	if field == "" {
+		return &appError{errors.New("Missing field parameter"), "Missing field query parameter", 400}
+	}
+	value, ok := distinctFields[field]
+	if !ok {
+		return &appError{fmt.Errorf("Unknown field %q", field), "Field must be country, region or city", 400}
+	}
+	f, e := parseFilter(r)
+	if e != nil {
+		return e
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+
+	key := field + "\x00" + f.key()
+	values := distinctValues.get(view.loadedAt, key, func() []string {
+		idx := f.candidates(view.byCountry)
+		size := len(view.recs)
+		if idx != nil {
+			size = len(idx)
+		}
+		seen := make(map[string]struct{})
+		for k := 0; k < size; k++ {
+			i := k
+			if idx != nil {
+				i = idx[k]
+			}
+			if !f.match(&view.recs[i]) {
+				continue
+			}
+			if v := value(&view.recs[i]); v != "" {
+				seen[v] = struct{}{}
+			}
+		}
+		values := make([]string, 0, len(seen))
+		for v := range seen {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		return values
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+//Values come from the records the dump's filters select, each once and sorted
+func TestDistinct(t *testing.T) {
+	useTestData(t)
+	saved := distinctValues
+	distinctValues = &distinctCache{}
+	t.Cleanup(func() { distinctValues = saved })
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"/distinct?field=country", []string{"AU", "CN", "US"}},
+		{"/distinct?field=country&country=us&country=cn", []string{"CN", "US"}},
+		{"/distinct?field=city&region=queensland&region=california", []string{"Brisbane", "Los Angeles"}},
+		{"/distinct?field=city&city_contains=an", []string{"Brisbane", "Los Angeles"}},
+		{"/distinct?field=region&country=US&city=fuzhou", []string{}},
+	}
+	for _, tt := range tests {
+		rr := get(appHandler(ip2locDistinct), tt.url)
+		if rr.Code != 200 {
+			t.Errorf("%s: status %d: %s", tt.url, rr.Code, rr.Body)
+			continue
+		}
+		var got []string
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	if rr := get(appHandler(ip2locDistinct), "/distinct?field=city&country=XX"); rr.Code != 400 {
+		t.Errorf("Unknown country answered %d, want 400", rr.Code)
+	}
+}
+
+//Each filter combination a client sends is a new key, but the cache holds at
+//most distinctCacheSize of them and still answers correctly past that
+func TestDistinctCacheBounded(t *testing.T) {
+	useTestData(t)
+	saved := distinctValues
+	distinctValues = &distinctCache{}
+	t.Cleanup(func() { distinctValues = saved })
+
+	for i := range 3 * distinctCacheSize {
+		url := fmt.Sprintf("/distinct?field=country&city_contains=%d", i)
+		if rr := get(appHandler(ip2locDistinct), url); rr.Code != 200 || rr.Body.String() != "[]\n" {
+			t.Fatalf("%s: status %d: %s", url, rr.Code, rr.Body)
+		}
+		distinctValues.mu.Lock()
+		n := len(distinctValues.values)
+		distinctValues.mu.Unlock()
+		if n > distinctCacheSize {
+			t.Fatalf("%d answers cached after %d requests, want at most %d", n, i+1, distinctCacheSize)
+		}
+	}
+	rr := get(appHandler(ip2locDistinct), "/distinct?field=country")
+	var got []string
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"AU", "CN", "US"}; !slices.Equal(got, want) {
+		t.Errorf("/distinct?field=country = %q after filling the cache, want %q", got, want)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Strong ETag for one representation of a dataset version. The query selects
+//format, filters and page, and Accept can select the format too, so both are
+//part of the tag; a refresh changes loadedAt and so every tag.
+func datasetETag(loadedAt time.Time, r *http.Request) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s", r.URL.RawQuery, r.Header.Get("Accept"))
+	return fmt.Sprintf(`"%x-%x"`, loadedAt.UnixNano(), h.Sum64())
+}
+
+//gzipHandler suffixes tags on compressed responses, so either form matches
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	gz := strings.TrimSuffix(etag, `"`) + gzipETagSuffix + `"`
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag || t == gz {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+//Ceiling for a single retry delay
+const maxFetchBackoff = time.Minute
+
+//Returned by fetch when the upstream answers 304 to the conditions sent
+var errNotModified = errors.New("Upstream data not modified")
+
+//Response headers identifying an upstream version, sent back as conditions
+//on the next fetch
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+//Retries connection errors and 5xx responses with exponential backoff
+func fetch(ctx context.Context, url string, cond validators) (*dataFile, error) {
+	start := time.Now()
+	defer func() { mtr.fetchDuration.Observe(time.Since(start).Seconds()) }()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var d *dataFile
+		var retry bool
+		if d, retry, err = fetchOnce(ctx, url, cond); err == nil || err == errNotModified {
+			return d, err
+		}
+		if !retry || attempt >= cfg.fetchAttempts {
+			mtr.fetchErrors.Inc()
+			return nil, fmt.Errorf("Fetch failed after %d attempt(s): %w", attempt, err)
+		}
+
+		//Full jitter: sleep a random duration up to base * 2^(attempt-1)
+		backoff := cfg.fetchBackoff << (attempt - 1)
+		if backoff > maxFetchBackoff || backoff < cfg.fetchBackoff {
+			backoff = maxFetchBackoff
+		}
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		log.Printf("Fetch attempt %d failed, retrying in %s: %v", attempt, delay, err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			mtr.fetchErrors.Inc()
+			return nil, fmt.Errorf("Fetch cancelled after %d attempt(s): %w", attempt, err)
+		case <-t.C:
+		}
+	}
+}
+
+var (
+	clientOnce     sync.Once
+	upstreamClient *http.Client
+)
+
+//Built on first use so it picks up the parsed flags; shared so connections are reused
+func fetchClient() *http.Client {
+	clientOnce.Do(func() {
+		//The clone keeps DefaultTransport's http.ProxyFromEnvironment
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if cfg.proxy != nil {
+			transport.Proxy = http.ProxyURL(cfg.proxy)
+		}
+		transport.DialContext = (&net.Dialer{
+			Timeout:   cfg.dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.MaxIdleConns = cfg.maxIdleConns
+		transport.IdleConnTimeout = cfg.idleConnTimeout
+		transport.DisableKeepAlives = cfg.disableKeepAlives
+		upstreamClient = &http.Client{
+			Timeout:   cfg.fetchTimeout,
+			Transport: transport,
+		}
+	})
+	return upstreamClient
+}
+
+//retry reports whether a failure is worth another attempt
+func fetchOnce(ctx context.Context, url string, cond validators) (d *dataFile, retry bool, err error) {
+	client := fetchClient()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	//An empty value suppresses Go's default rather than sending a blank header
+	req.Header.Set("User-Agent", cfg.userAgent)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if cond.etag != "" {
+		req.Header.Set("If-None-Match", cond.etag)
+	}
+	if cond.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cond.lastModified)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, false, errNotModified
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, res.StatusCode >= 500, fmt.Errorf("Upstream responded %s", res.Status)
+	}
+
+	if cfg.maxDownload > 0 && res.ContentLength > cfg.maxDownload {
+		return nil, false, fmt.Errorf("Upstream response of %d bytes exceeds -max-download of %d", res.ContentLength, cfg.maxDownload)
+	}
+
+	//A proxy compressing the zip again; Go only undoes this itself when it
+	//asked for gzip, so an unrequested encoding is handled here
+	var body io.Reader = res.Body
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, false, sourceError{err}
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	f, err := os.CreateTemp("", "ip2loc-*.zip")
+	if err != nil {
+		return nil, false, err
+	}
+	d = &dataFile{File: f, temp: true, validators: validators{
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}}
+	//Content-Length may be missing, wrong, or describe the compressed body
+	if cfg.maxDownload > 0 {
+		body = io.LimitReader(body, cfg.maxDownload+1)
+	}
+	h := sha256.New()
+	if d.size, err = io.Copy(io.MultiWriter(f, h), body); err != nil {
+		d.Close()
+		return nil, ctx.Err() == nil, err
+	}
+	if cfg.maxDownload > 0 && d.size > cfg.maxDownload {
+		d.Close()
+		return nil, false, fmt.Errorf("Upstream response exceeds -max-download of %d bytes", cfg.maxDownload)
+	}
+	d.sha256 = hex.EncodeToString(h.Sum(nil))
+	return d, false, nil
+}
+
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Upstream gzipping its response, whether or not Go's transport asked for it
+//and so undoes it itself, or serving a .csv.gz with no zip layer
+func TestFetchGzip(t *testing.T) {
+	zipped := testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV)
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		//Leaves the Content-Encoding to fetchOnce
+		noTransportGzip bool
+	}{
+		{"zip with Content-Encoding", testGzip(t, zipped), "gzip", false},
+		{"zip with unrequested Content-Encoding", testGzip(t, zipped), "gzip", true},
+		{"csv.gz", testGzip(t, []byte(testCSV)), "", false},
+		{"csv.gz with Content-Encoding", testGzip(t, testGzip(t, []byte(testCSV))), "gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}))
+			t.Cleanup(up.Close)
+			useUpstream(t, up.URL)
+			freshClient(t)
+			fetchClient().Transport.(*http.Transport).DisableCompression = tt.noTransportGzip
+
+			recs, e := loadAll()
+			if e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			if len(recs) != 3 {
+				t.Errorf("Loaded %d records, want 3", len(recs))
+			}
+		})
+	}
+}
+
+//-max-download holds whether upstream declares the size up front or not
+func TestFetchMaxDownload(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("chunked") {
+			//Flushing first leaves Content-Length unset
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(up.Close)
+
+	tests := []struct {
+		name    string
+		query   string
+		max     int64
+		wantErr bool
+	}{
+		{"declared over", "", 999, true},
+		{"streamed over", "?chunked", 999, true},
+		{"declared at limit", "", 1000, false},
+		{"streamed at limit", "?chunked", 1000, false},
+		{"unlimited", "?chunked", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, up.URL+tt.query)
+			cfg.maxDownload = tt.max
+			d, err := fetch(context.Background(), cfg.upstream, validators{})
+			if tt.wantErr {
+				if err == nil {
+					d.Close()
+					t.Fatalf("Fetched %d bytes past -max-download of %d", d.size, tt.max)
+				}
+				if !strings.Contains(err.Error(), "exceeds -max-download") {
+					t.Errorf("Error %q does not name the limit", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			if d.size != int64(len(body)) {
+				t.Errorf("Fetched %d bytes, want %d", d.size, len(body))
+			}
+		})
+	}
+}
+
+func TestFetchUserAgent(t *testing.T) {
+	var got []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Values("User-Agent")
+	}))
+	t.Cleanup(up.Close)
+
+	for _, tt := range []struct {
+		name, agent string
+		want        []string
+	}{
+		{"default", "adsGO-csv-parser/1.0", []string{"adsGO-csv-parser/1.0"}},
+		{"custom", "ops-mirror/2 (+https://example.com)", []string{"ops-mirror/2 (+https://example.com)"}},
+		{"none", "", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, up.URL)
+			if tt.name != "default" {
+				cfg.userAgent = tt.agent
+			}
+			d, err := fetch(context.Background(), cfg.upstream, validators{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.Close()
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("Upstream saw User-Agent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+//With -proxy, the download goes to the proxy asking for the upstream URL. The
+//upstream host does not resolve, so only the proxy can answer.
+func TestFetchProxy(t *testing.T) {
+	zipped := testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV)
+	var asked []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.URL.String())
+		w.Write(zipped)
+	}))
+	t.Cleanup(proxy.Close)
+
+	useUpstream(t, "http://ip2location.invalid/download?token=x")
+	freshClient(t)
+	if err := setProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	recs, e := loadAll()
+	if e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	if len(recs) != 3 {
+		t.Errorf("Loaded %d records, want 3", len(recs))
+	}
+	if len(asked) != 1 || asked[0] != cfg.upstream {
+		t.Errorf("Proxy was asked for %q, want just %s", asked, cfg.upstream)
+	}
+
+	for _, bad := range []string{"proxy:3128", "ftp://proxy:21", "http://"} {
+		if err := setProxy(bad); err == nil {
+			t.Errorf("Accepted proxy %q", bad)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//Query parameter filters for the record dump; an empty filter matches everything.
+//Different parameters must all match, repeated ones match any of their values.
+type recFilter struct {
+	countries map[string]struct{}
+
+	//Lower-cased ?region= and ?city= values. Both are only kept for
+	//supported countries, so other countries never match.
+	regions map[string]struct{}
+	cities  map[string]struct{}
+	//Lower-cased ?city_contains= substrings
+	cityParts []string
+}
+
+func parseFilter(r *http.Request) (*recFilter, *appError) {
+	f := &recFilter{}
+	q := r.URL.Query()
+
+	for _, c := range q["country"] {
+		code, e := parseCountry(c)
+		if e != nil {
+			return nil, e
+		}
+		if f.countries == nil {
+			f.countries = make(map[string]struct{})
+		}
+		f.countries[code] = struct{}{}
+	}
+	f.regions = nameSet(q["region"])
+	f.cities = nameSet(q["city"])
+	for _, part := range q["city_contains"] {
+		if part = strings.TrimSpace(part); part != "" {
+			f.cityParts = append(f.cityParts, strings.ToLower(part))
+		}
+	}
+	return f, nil
+}
+
+//Lower-cased non-empty values, or nil if there are none
+func nameSet(values []string) map[string]struct{} {
+	var set map[string]struct{}
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]struct{})
+		}
+		set[strings.ToLower(v)] = struct{}{}
+	}
+	return set
+}
+
+//A ?country= value as an upper-case ISO 3166-1 code
+func parseCountry(c string) (string, *appError) {
+	code := strings.ToUpper(strings.TrimSpace(c))
+	if _, ok := isoCountries[code]; !ok {
+		return "", &appError{fmt.Errorf("Unknown country code %q", c), "Unknown country query parameter", 400}
+	}
+	return code, nil
+}
+
+func (f *recFilter) match(rec *ip2locRec) bool {
+	if f.countries != nil {
+		if _, ok := f.countries[strings.ToUpper(rec.CountryCode)]; !ok {
+			return false
+		}
+	}
+	if f.regions != nil {
+		if _, ok := f.regions[strings.ToLower(rec.Region)]; !ok {
+			return false
+		}
+	}
+	if f.cities != nil {
+		if _, ok := f.cities[strings.ToLower(rec.City)]; !ok {
+			return false
+		}
+	}
+	if f.cityParts != nil {
+		city := strings.ToLower(rec.City)
+		found := false
+		for _, part := range f.cityParts {
+			if strings.Contains(city, part) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+//The same for every request asking for the same records, for caching answers
+func (f *recFilter) key() string {
+	sorted := func(set map[string]struct{}) string {
+		keys := make([]string, 0, len(set))
+		for k := range set {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return strings.Join(keys, ",")
+	}
+	parts := slices.Clone(f.cityParts)
+	sort.Strings(parts)
+	return strings.Join([]string{sorted(f.countries), sorted(f.regions), sorted(f.cities), strings.Join(parts, ",")}, "\x00")
+}
+
+//Indices of the records that may match, in record order, or nil when every
+//record has to be checked
+func (f *recFilter) candidates(byCountry map[string][]int) []int {
+	if f.countries == nil {
+		return nil
+	}
+	idx := []int{}
+	for code := range f.countries {
+		idx = append(idx, byCountry[code]...)
+	}
+	if len(f.countries) > 1 {
+		sort.Ints(idx)
+	}
+	return idx
+}
+
+//Pagination over the filtered records; a negative limit means no limit
+type page struct {
+	offset int
+	limit  int
+}
+
+func parsePage(r *http.Request) (page, *appError) {
+	p := page{limit: -1}
+	q := r.URL.Query()
+
+	for _, param := range []struct {
+		name string
+		dst  *int
+	}{{"offset", &p.offset}, {"limit", &p.limit}} {
+		v := q.Get(param.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return page{}, &appError{fmt.Errorf("Invalid %s %q", param.name, v), "Invalid " + param.name + " query parameter", 400}
+		}
+		*param.dst = n
+	}
+	return p, nil
+}
+
+//Number of records the page holds out of total matches
+func (p page) length(total int) int {
+	n := total - p.offset
+	if n < 0 {
+		n = 0
+	}
+	if p.limit >= 0 && n > p.limit {
+		n = p.limit
+	}
+	return n
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Output formats for the record dump
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatArray  = "json-array"
+	formatCSV    = "csv"
+	formatProto  = "protobuf"
+	formatPack   = "msgpack"
+)
+
+var contentTypes = map[string]string{
+	formatJSON:   "application/json; charset=UTF-8",
+	formatNDJSON: "application/x-ndjson",
+	formatArray:  "application/json; charset=UTF-8",
+	formatCSV:    "text/csv; charset=UTF-8",
+	formatProto:  "application/x-protobuf",
+	formatPack:   "application/msgpack",
+}
+
+//Writes records in one output format; Close writes any trailing bytes
+type recEncoder interface {
+	Encode(rec *ip2locRec) error
+	Close() error
+}
+
+//Buffer between the record encoders and the connection
+const respBufSize = 64 << 10
+
+//Buffers a record dump so encoding doesn't cost a write per record. Flush
+//sends what is buffered on to the client as a chunk.
+type dumpWriter struct {
+	*bufio.Writer
+	flusher http.Flusher
+}
+
+func newDumpWriter(w http.ResponseWriter) *dumpWriter {
+	flusher, _ := w.(http.Flusher)
+	return &dumpWriter{bufio.NewWriterSize(w, respBufSize), flusher}
+}
+
+func (w *dumpWriter) Flush() error {
+	if err := w.Writer.Flush(); err != nil {
+		return err
+	}
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return nil
+}
+
+//Media types clients may ask for in Accept, in order of preference on a tie.
+//json-array shares JSON's media type, so it is only reachable with ?format=.
+var negotiable = []struct {
+	format, mediaType string
+}{
+	{formatJSON, "application/json"},
+	{formatNDJSON, "application/x-ndjson"},
+	{formatCSV, "text/csv"},
+	{formatProto, "application/x-protobuf"},
+	{formatPack, "application/msgpack"},
+}
+
+//?format= wins over the Accept header; with neither, the default is JSON
+func outputFormat(r *http.Request) (string, *appError) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := contentTypes[f]; !ok {
+			return "", &appError{fmt.Errorf("Unsupported format %q", f), "Unsupported format query parameter", 400}
+		}
+		return f, nil
+	}
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formatJSON, nil
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, n := range negotiable {
+		if q := acceptQuality(ranges, n.mediaType); q > bestQ {
+			best, bestQ = n.format, q
+		}
+	}
+	if best == "" {
+		return "", &appError{fmt.Errorf("No supported type in Accept %q", accept), "Not Acceptable: supported types are application/json, application/x-ndjson, text/csv, application/x-protobuf and application/msgpack", 406}
+	}
+	return best, nil
+}
+
+//One media range from an Accept header, such as text/* or application/json;q=0.5
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		ar := acceptRange{mediaType: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		if ar.mediaType == "" {
+			continue
+		}
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				q, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					q = 0
+				}
+				ar.q = q
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	return ranges
+}
+
+//The q value of the most specific range matching mediaType, or 0 if none does
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, 0
+	for _, ar := range ranges {
+		s := 0
+		switch ar.mediaType {
+		case mediaType:
+			s = 3
+		case typ + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+		if s > specificity {
+			q, specificity = ar.q, s
+		}
+	}
+	return q
+}
+
+func newRecEncoder(format string, w io.Writer) recEncoder {
+	switch format {
+	case formatArray:
+		return &jsonArrayEncoder{w: w, enc: json.NewEncoder(w)}
+	case formatCSV:
+		return &csvEncoder{w: csv.NewWriter(w)}
+	case formatProto:
+		return &protobufEncoder{w: w}
+	case formatPack:
+		return newMsgpackEncoder(w)
+	case formatJSON:
+		return &jsonLinesEncoder{w: w, enc: json.NewEncoder(w), emptyArray: true}
+	default:
+		return &jsonLinesEncoder{w: w, enc: json.NewEncoder(w)}
+	}
+}
+
+//JSON and NDJSON are both one object per line. A JSON dump nothing matched is
+//an empty array rather than an empty body, which is not valid JSON; NDJSON
+//stays empty, zero lines.
+type jsonLinesEncoder struct {
+	w          io.Writer
+	enc        *json.Encoder
+	emptyArray bool
+	started    bool
+}
+
+func (e *jsonLinesEncoder) Encode(rec *ip2locRec) error {
+	e.started = true
+	return e.enc.Encode(rec)
+}
+
+func (e *jsonLinesEncoder) Close() error {
+	if e.emptyArray && !e.started {
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	}
+	return nil
+}
+
+//Streams a single valid JSON array without buffering the records
+type jsonArrayEncoder struct {
+	w       io.Writer
+	enc     *json.Encoder
+	started bool
+}
+
+func (e *jsonArrayEncoder) Encode(rec *ip2locRec) error {
+	sep := ","
+	if !e.started {
+		sep = "["
+		e.started = true
+	}
+	if _, err := io.WriteString(e.w, sep); err != nil {
+		return err
+	}
+	return e.enc.Encode(rec)
+}
+
+func (e *jsonArrayEncoder) Close() error {
+	if !e.started {
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+var csvHeader = []string{"toIP", "countryCode", "region", "city"}
+
+type csvEncoder struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+//Written before the first row, or on Close when there are no rows
+func (e *csvEncoder) header() error {
+	if e.wroteHeader {
+		return nil
+	}
+	e.wroteHeader = true
+	return e.w.Write(csvHeader)
+}
+
+func (e *csvEncoder) Encode(rec *ip2locRec) error {
+	if err := e.header(); err != nil {
+		return err
+	}
+	return e.w.Write([]string{rec.ToIP.String(), rec.CountryCode, rec.Region, rec.City})
+}
+
+func (e *csvEncoder) Close() error {
+	if err := e.header(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
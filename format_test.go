@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Loads testCSV into the cache so "/" serves it straight away
+func warmTestData(t testing.TB) {
+	t.Helper()
+	useTestData(t)
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Loading test data: %v: %s", e.Error, e.Message)
+	}
+}
+
+func TestJSONArray(t *testing.T) {
+	warmTestData(t)
+	for _, tt := range []struct {
+		url  string
+		want []string
+	}{
+		{"/?format=json-array", []string{"AU", "CN", "US"}},
+		{"/?format=json-array&country=cn", []string{"CN"}},
+		{"/?format=json-array&country=fr", []string{}},
+	} {
+		rr := get(appHandler(ip2locInit), tt.url)
+		if rr.Code != 200 {
+			t.Fatalf("%s: status %d: %s", tt.url, rr.Code, rr.Body)
+		}
+		var recs []ip2locRec
+		if err := json.Unmarshal(rr.Body.Bytes(), &recs); err != nil {
+			t.Fatalf("%s: output is not a JSON array: %v\n%s", tt.url, err, rr.Body)
+		}
+		if len(recs) != len(tt.want) {
+			t.Fatalf("%s: decoded %d records, want %d", tt.url, len(recs), len(tt.want))
+		}
+		for i, rec := range recs {
+			if rec.CountryCode != tt.want[i] || rec.ToIP.Sign() == 0 {
+				t.Errorf("%s: record %d is %+v, want one in %s", tt.url, i, rec, tt.want[i])
+			}
+		}
+	}
+}
+
+//A filter nothing matches is a 200 with an empty array in both JSON formats,
+//and no lines at all in NDJSON
+func TestDumpNoMatches(t *testing.T) {
+	warmTestData(t)
+	for _, tt := range []struct {
+		url  string
+		want string
+	}{
+		{"/?city=nowhere", "[]\n"},
+		{"/?country=au&city_contains=zzz", "[]\n"},
+		{"/?format=json-array&city=nowhere", "[]\n"},
+		{"/?format=ndjson&city=nowhere", ""},
+	} {
+		rr := get(appHandler(ip2locInit), tt.url)
+		if rr.Code != 200 || rr.Body.String() != tt.want {
+			t.Errorf("%s: status %d, body %q; want 200 and %q", tt.url, rr.Code, rr.Body, tt.want)
+		}
+	}
+}
+
+//Dumping a large dataset over a real connection, in each streaming format
+func BenchmarkDump(b *testing.B) {
+	keepConfig(b)
+	freshCache(b)
+	var csv strings.Builder
+	for _, row := range testRows(64 * parseBatch) {
+		fmt.Fprintf(&csv, "%q,%q,%q,%q,%q,%q\n", row[0], row[1], row[2], row[3], row[4], row[5])
+	}
+	cfg.file = writeTemp(b, "bench.csv", []byte(csv.String()))
+	cfg.archive = "csv"
+	if _, e := cache.get(context.Background()); e != nil {
+		b.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	srv := httptest.NewServer(appHandler(ip2locInit))
+	b.Cleanup(srv.Close)
+
+	for _, format := range []string{formatJSON, formatNDJSON, formatCSV} {
+		b.Run(format, func(b *testing.B) {
+			var n int64
+			for i := 0; i < b.N; i++ {
+				res, err := http.Get(srv.URL + "/?format=" + format)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err = io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(n)
+			b.ReportMetric(float64(64*parseBatch*b.N)/b.Elapsed().Seconds(), "records/s")
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//The IP2Location service from ip2loc.proto. The descriptor and messages are
+//hand-written like protobuf.go's encoder, so the build needs no protoc
+//output; grpcCodec puts them on the wire with the standard proto encoding.
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ip2loc.IP2Location",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Lookup", Handler: grpcLookupHandler},
+		{MethodName: "Stats", Handler: grpcStatsHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "BulkLookup", Handler: grpcBulkLookup, ServerStreams: true, ClientStreams: true},
+	},
+	Metadata: "ip2loc.proto",
+}
+
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.ForceServerCodec(grpcCodec{}))
+	srv.RegisterService(&grpcServiceDesc, struct{}{})
+	return srv
+}
+
+type grpcMessage interface {
+	marshalProto() []byte
+	unmarshalProto([]byte) error
+}
+
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string {
+	return "proto"
+}
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(grpcMessage)
+	if !ok {
+		return nil, fmt.Errorf("Cannot marshal %T", v)
+	}
+	return m.marshalProto(), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(grpcMessage)
+	if !ok {
+		return fmt.Errorf("Cannot unmarshal into %T", v)
+	}
+	return m.unmarshalProto(data)
+}
+
+type ipMessage struct {
+	IP string
+}
+
+func (m *ipMessage) marshalProto() []byte {
+	return appendProtoString(nil, 1, m.IP)
+}
+
+func (m *ipMessage) unmarshalProto(b []byte) error {
+	*m = ipMessage{}
+	return eachProtoField(b, func(field int, wire int, v []byte) {
+		if field == 1 && wire == wireBytes {
+			m.IP = string(v)
+		}
+	})
+}
+
+//A nil rec is sent as an empty Record
+type recordMessage struct {
+	rec *ip2locRec
+}
+
+func (m *recordMessage) marshalProto() []byte {
+	if m.rec == nil {
+		return nil
+	}
+	return appendProtoRecord(nil, m.rec)
+}
+
+func (m *recordMessage) unmarshalProto([]byte) error {
+	return errors.New("Record is only sent by the server")
+}
+
+type statsRequest struct{}
+
+func (*statsRequest) marshalProto() []byte {
+	return nil
+}
+
+//Unknown fields are skipped, as proto3 requires
+func (*statsRequest) unmarshalProto(b []byte) error {
+	return eachProtoField(b, func(int, int, []byte) {})
+}
+
+type statsMessage struct {
+	st *datasetStats
+}
+
+func (m *statsMessage) marshalProto() []byte {
+	st := m.st
+	b := appendProtoInt(nil, 1, int64(st.Records))
+	b = appendProtoCounts(b, 2, st.Countries)
+	b = appendProtoCounts(b, 3, st.Continents)
+	b = appendProtoInt(b, 4, int64(st.WithRegion))
+	b = appendProtoInt(b, 5, int64(st.WithCity))
+	b = appendProtoString(b, 6, st.LastRefresh.Format(time.RFC3339))
+	if st.DatasetDate != nil {
+		b = appendProtoString(b, 7, st.DatasetDate.Format(time.RFC3339))
+	}
+	return appendProtoInt(b, 8, int64(st.SkippedRows))
+}
+
+func (m *statsMessage) unmarshalProto([]byte) error {
+	return errors.New("Stats is only sent by the server")
+}
+
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+//A map<string, int64>, one entry message per key. Keys are sorted so the
+//same stats always encode the same way.
+func appendProtoCounts(b []byte, field int, counts map[string]int) []byte {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var entry []byte
+	for _, k := range keys {
+		entry = appendProtoString(entry[:0], 1, k)
+		entry = appendProtoInt(entry, 2, int64(counts[k]))
+		b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+		b = binary.AppendUvarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+//Calls fn with each field of a message. v holds the payload of length
+//delimited fields; other wire types are skipped over.
+func eachProtoField(b []byte, fn func(field int, wire int, v []byte)) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("Malformed field tag")
+		}
+		b = b[n:]
+		field, wire := int(tag>>3), int(tag&7)
+		switch wire {
+		case wireVarint:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("Malformed varint")
+			}
+			b = b[n:]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return errors.New("Truncated fixed-width field")
+			}
+			b = b[size:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errors.New("Truncated length-delimited field")
+			}
+			fn(field, wire, b[n:n+int(size)])
+			b = b[n+int(size):]
+		default:
+			return fmt.Errorf("Unsupported wire type %d", wire)
+		}
+	}
+	return nil
+}
+
+//The HTTP API's -api-key check, reading the key from x-api-key or
+//authorization metadata
+func grpcAuth(ctx context.Context) error {
+	if cfg.apiKey == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var got string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		got = v[0]
+	} else if v := md.Get("authorization"); len(v) > 0 {
+		got, _ = strings.CutPrefix(v[0], "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(cfg.apiKey)) != 1 {
+		logger.Warn("Rejected gRPC call without a valid API key")
+		return status.Error(codes.Unauthenticated, "Missing or invalid API key")
+	}
+	return nil
+}
+
+//e as a gRPC status carrying the message the HTTP API would answer with
+func grpcError(ctx context.Context, e *appError) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(ctx.Err(), context.Canceled):
+		code = codes.Canceled
+	case e.Code == 400:
+		code = codes.InvalidArgument
+	case e.Code == 404:
+		code = codes.NotFound
+	case e.Code == 502 || e.Code == 503:
+		code = codes.Unavailable
+	}
+	if code == codes.Internal || code == codes.Unavailable {
+		logger.Error(e.Message, "error", e.Error, "status", e.Code)
+	}
+	return status.Error(code, e.Message)
+}
+
+func grpcLookupHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := new(ipMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return grpcLookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/ip2loc.IP2Location/Lookup"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+		return grpcLookup(ctx, req.(*ipMessage))
+	})
+}
+
+func grpcLookup(ctx context.Context, in *ipMessage) (*recordMessage, error) {
+	if err := grpcAuth(ctx); err != nil {
+		return nil, err
+	}
+	ip, err := parseIP(in.IP)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid ip %q", in.IP)
+	}
+	if _, e := cache.get(ctx); e != nil {
+		return nil, grpcError(ctx, e)
+	}
+	view, _ := cache.snapshot()
+	rec, ok := view.lookup(ip)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "No IP2Location record found for ip")
+	}
+	return &recordMessage{&rec}, nil
+}
+
+//Answers each IP as it arrives, so a client can stream any number of them.
+//The dataset is snapshotted once, keeping every answer from the same load.
+func grpcBulkLookup(srv any, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	if err := grpcAuth(ctx); err != nil {
+		return err
+	}
+	var view cacheView
+	loaded := false
+	for {
+		in := new(ipMessage)
+		if err := stream.RecvMsg(in); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		ip, err := parseIP(in.IP)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid ip %q", in.IP)
+		}
+		if !loaded {
+			if _, e := cache.get(ctx); e != nil {
+				return grpcError(ctx, e)
+			}
+			view, _ = cache.snapshot()
+			loaded = true
+		}
+		out := &recordMessage{}
+		if rec, ok := view.lookup(ip); ok {
+			out.rec = &rec
+		}
+		if err := stream.SendMsg(out); err != nil {
+			return err
+		}
+	}
+}
+
+func grpcStatsHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := new(statsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return grpcStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/ip2loc.IP2Location/Stats"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req any) (any, error) {
+		return grpcStats(ctx, req.(*statsRequest))
+	})
+}
+
+func grpcStats(ctx context.Context, _ *statsRequest) (*statsMessage, error) {
+	if err := grpcAuth(ctx); err != nil {
+		return nil, err
+	}
+	if _, e := cache.get(ctx); e != nil {
+		return nil, grpcError(ctx, e)
+	}
+	summary, loadedAt := cache.stats()
+	st := *summary
+	st.LastRefresh = loadedAt
+	return &statsMessage{&st}, nil
+}
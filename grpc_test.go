@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//A client of newGRPCServer over an in-memory connection. Messages are
+//dynamicpb ones built from ip2loc.proto and go through grpc-go's standard
+//proto codec, as they would for a client generated by protoc.
+func grpcTestClient(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+//An ip2loc.IP message
+func ipMsg(schema protoreflect.FileDescriptor, ip string) *dynamicpb.Message {
+	msg := dynamicpb.NewMessage(schema.Messages().ByName("IP"))
+	msg.Set(msg.Descriptor().Fields().ByName("ip"), protoreflect.ValueOfString(ip))
+	return msg
+}
+
+func TestGRPCLookup(t *testing.T) {
+	warmCoordData(t)
+	schema := protoSchema(t)
+	conn := grpcTestClient(t)
+	view, _ := cache.snapshot()
+
+	tests := []struct {
+		ip   string
+		code codes.Code
+		want *ip2locRec
+	}{
+		{"1.0.0.5", codes.OK, &view.recs[0]},
+		{"2001:db8::1", codes.OK, &view.recs[2]},
+		{"0.0.0.1", codes.NotFound, nil},
+		{"not an ip", codes.InvalidArgument, nil},
+	}
+	for _, tt := range tests {
+		out := dynamicpb.NewMessage(schema.Messages().ByName("Record"))
+		err := conn.Invoke(t.Context(), "/ip2loc.IP2Location/Lookup", ipMsg(schema, tt.ip), out)
+		if status.Code(err) != tt.code {
+			t.Errorf("Lookup(%s) = %v, want %s", tt.ip, err, tt.code)
+			continue
+		}
+		if tt.want != nil && !proto.Equal(out, schemaRecord(schema, tt.want)) {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.ip, out, schemaRecord(schema, tt.want))
+		}
+	}
+}
+
+//Answers come back in order, with an empty Record for an IP no range covers
+func TestGRPCBulkLookup(t *testing.T) {
+	warmCoordData(t)
+	schema := protoSchema(t)
+	conn := grpcTestClient(t)
+	view, _ := cache.snapshot()
+
+	stream, err := conn.NewStream(t.Context(), &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, "/ip2loc.IP2Location/BulkLookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []string{"1.0.0.5", "0.0.0.1", "2001:db8::1"}
+	for _, ip := range ips {
+		if err := stream.SendMsg(ipMsg(schema, ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	empty := dynamicpb.NewMessage(schema.Messages().ByName("Record"))
+	want := []proto.Message{schemaRecord(schema, &view.recs[0]), empty, schemaRecord(schema, &view.recs[2])}
+	for i := 0; ; i++ {
+		out := dynamicpb.NewMessage(schema.Messages().ByName("Record"))
+		err := stream.RecvMsg(out)
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("Stream ended after %d answers, want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			t.Fatalf("Answer %d for %d IPs", i, len(ips))
+		}
+		if !proto.Equal(out, want[i]) {
+			t.Errorf("Answer %d for %s = %v, want %v", i, ips[i], out, want[i])
+		}
+	}
+}
+
+//Stats carries the summary GET /stats serves, in fields ip2loc.proto defines
+func TestGRPCStats(t *testing.T) {
+	warmCoordData(t)
+	schema := protoSchema(t)
+	conn := grpcTestClient(t)
+
+	out := dynamicpb.NewMessage(schema.Messages().ByName("Stats"))
+	if err := conn.Invoke(t.Context(), "/ip2loc.IP2Location/Stats", dynamicpb.NewMessage(schema.Messages().ByName("StatsRequest")), out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.GetUnknown()) > 0 {
+		t.Errorf("Stats has fields ip2loc.proto does not define: %v", out)
+	}
+	fields := out.Descriptor().Fields()
+	if n := out.Get(fields.ByName("records")).Int(); n != 3 {
+		t.Errorf("records = %d, want 3", n)
+	}
+	countries := out.Get(fields.ByName("countries")).Map()
+	for _, code := range []string{"AU", "CN", "US"} {
+		if n := countries.Get(protoreflect.ValueOfString(code).MapKey()).Int(); n != 1 {
+			t.Errorf("countries[%s] = %d, want 1", code, n)
+		}
+	}
+	if out.Get(fields.ByName("last_refresh")).String() == "" {
+		t.Error("No last_refresh")
+	}
+}
+
+//With -api-key set every call needs it, in x-api-key or as a bearer token
+func TestGRPCAuth(t *testing.T) {
+	warmCoordData(t)
+	schema := protoSchema(t)
+	conn := grpcTestClient(t)
+	cfg.apiKey = "secret"
+
+	tests := []struct {
+		name string
+		md   []string
+		code codes.Code
+	}{
+		{"no key", nil, codes.Unauthenticated},
+		{"wrong key", []string{"x-api-key", "guess"}, codes.Unauthenticated},
+		{"x-api-key", []string{"x-api-key", "secret"}, codes.OK},
+		{"bearer", []string{"authorization", "Bearer secret"}, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(t.Context(), tt.md...)
+			out := dynamicpb.NewMessage(schema.Messages().ByName("Record"))
+			if err := conn.Invoke(ctx, "/ip2loc.IP2Location/Lookup", ipMsg(schema, "1.0.0.5"), out); status.Code(err) != tt.code {
+				t.Errorf("Lookup = %v, want %s", err, tt.code)
+			}
+			stats := dynamicpb.NewMessage(schema.Messages().ByName("Stats"))
+			if err := conn.Invoke(ctx, "/ip2loc.IP2Location/Stats", dynamicpb.NewMessage(schema.Messages().ByName("StatsRequest")), stats); status.Code(err) != tt.code {
+				t.Errorf("Stats = %v, want %s", err, tt.code)
+			}
+
+			stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, "/ip2loc.IP2Location/BulkLookup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.SendMsg(ipMsg(schema, "1.0.0.5"))
+			stream.CloseSend()
+			if err := stream.RecvMsg(dynamicpb.NewMessage(schema.Messages().ByName("Record"))); status.Code(err) != tt.code {
+				t.Errorf("BulkLookup = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
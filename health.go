@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type healthStatus struct {
+	Status      string     `json:"status"`
+	LastRefresh *time.Time `json:"lastRefresh,omitempty"`
+}
+
+//Liveness only; never touches the upstream server so it is cheap to poll
+func health(w http.ResponseWriter, r *http.Request) {
+	st := healthStatus{Status: "ok"}
+	if t := cache.lastRefresh(); !t.IsZero() {
+		st.LastRefresh = &t
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(&st)
+}
+
+//Readiness: 503 until the first successful load. The cache never drops its
+//records on a failed refresh, so once ready this stays ready.
+func ready(w http.ResponseWriter, r *http.Request) {
+	st := healthStatus{Status: "ready"}
+	code := http.StatusOK
+	if t := cache.lastRefresh(); !t.IsZero() {
+		st.LastRefresh = &t
+	} else {
+		st.Status = "loading"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&st)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//Logs are only shown with -v, as most tests provoke errors on purpose
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	}
+	os.Exit(m.Run())
+}
+
+//Rows in the layout of IPV6-COUNTRY-REGION-CITY.CSV: an unassigned range,
+//then one range for each of three countries
+const testCSV = `"0","16777215","-","-","-","-"
+"16777216","16777471","AU","Australia","Queensland","Brisbane"
+"16777472","16778239","CN","China","Fujian","Fuzhou"
+"16778240","16779263","US","United States of America","California","Los Angeles"
+`
+
+//Puts cfg back as it was when the test ends, so a test may change any setting
+func keepConfig(t testing.TB) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+}
+
+//Before the test's settings are put back, waits for the goroutines it started
+//to exit, such as a pipeline still unwinding after load returned. Call it
+//after keepConfig so it runs first.
+func awaitGoroutines(t testing.TB) {
+	t.Helper()
+	baseline := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > baseline {
+			if time.Now().After(deadline) {
+				t.Errorf("%d goroutines still running, %d before the test", runtime.NumGoroutine(), baseline)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+//Puts supportedCountries back as it was when the test ends
+func keepSupported(t testing.TB) {
+	t.Helper()
+	supportedMu.RLock()
+	saved := maps.Clone(supportedCountries)
+	supportedMu.RUnlock()
+	t.Cleanup(func() {
+		supportedMu.Lock()
+		supportedCountries = saved
+		supportedMu.Unlock()
+	})
+}
+
+//Swaps in an empty cache for the test
+func freshCache(t testing.TB) {
+	t.Helper()
+	saved := cache
+	cache = &recCache{ctx: context.Background()}
+	t.Cleanup(func() { cache = saved })
+}
+
+//Swaps in an empty metrics registry for the test
+func freshMetrics(t testing.TB) {
+	t.Helper()
+	savedReg, saved := metricsRegistry, mtr
+	useMetrics(prometheus.NewRegistry())
+	t.Cleanup(func() { metricsRegistry, mtr = savedReg, saved })
+}
+
+//Has fetch build its client again from the test's settings, and again for
+//whatever runs after the test
+func freshClient(t testing.TB) {
+	t.Helper()
+	clientOnce, upstreamClient = sync.Once{}, nil
+	t.Cleanup(func() { clientOnce, upstreamClient = sync.Once{}, nil })
+}
+
+//A record covering from-to in country
+func testRec(from, to int64, country string) ip2locRec {
+	var rec ip2locRec
+	rec.FromIP.SetInt64(from)
+	rec.ToIP.SetInt64(to)
+	rec.CountryCode = country
+	return rec
+}
+
+//body gzipped
+func testGzip(t testing.TB, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//A zip holding each name with the body that follows it
+func testZip(t testing.TB, nameBodies ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(nameBodies); i += 2 {
+		f, err := zw.Create(nameBodies[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(f, nameBodies[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//An upstream serving data on every path
+func testUpstream(t testing.TB, data []byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+//Points the config at upstream with an empty cache and no copy on disk. A
+//failed fetch is not retried, to keep error tests quick.
+func useUpstream(t testing.TB, upstream string) {
+	t.Helper()
+	keepConfig(t)
+	freshCache(t)
+	cfg.upstream = upstream
+	cfg.file = ""
+	cfg.cacheDir = ""
+	cfg.fetchAttempts = 1
+}
+
+//Serves testCSV zipped the way IP2Location ships it
+func useTestData(t testing.TB) {
+	t.Helper()
+	useUpstream(t, testUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV)).URL)
+}
+
+func serveRequest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+func get(h http.Handler, url string) *httptest.ResponseRecorder {
+	return serveRequest(h, httptest.NewRequest("GET", url, nil))
+}
+
+//Writes data to name in a directory removed after the test, returning its path
+func writeTemp(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+)
+
+//Lookup structure for datasets whose ranges overlap. Sorted by toIP, a
+//disjoint dataset is answered by lookup directly, gaps included, so this is
+//only built when some range starts at or below the end of the one before it.
+type intervalIndex struct {
+	//Indices into recs ordered by FromIP
+	byFrom []int
+	//maxTo[k] is the largest ToIP among byFrom[:k+1], pointing into recs
+	maxTo []*big.Int
+}
+
+//nil when no two ranges in recs overlap
+func buildIntervals(recs []ip2locRec) *intervalIndex {
+	overlap := false
+	for i := 1; i < len(recs); i++ {
+		if recs[i].FromIP.Cmp(&recs[i-1].ToIP) <= 0 {
+			overlap = true
+			break
+		}
+	}
+	if !overlap {
+		return nil
+	}
+
+	ix := &intervalIndex{byFrom: make([]int, len(recs)), maxTo: make([]*big.Int, len(recs))}
+	for i := range ix.byFrom {
+		ix.byFrom[i] = i
+	}
+	//Ranges sharing a start are ordered widest first, so the walk back in
+	//find meets the innermost one first
+	sort.SliceStable(ix.byFrom, func(a, b int) bool {
+		ra, rb := &recs[ix.byFrom[a]], &recs[ix.byFrom[b]]
+		if c := ra.FromIP.Cmp(&rb.FromIP); c != 0 {
+			return c < 0
+		}
+		return ra.ToIP.Cmp(&rb.ToIP) > 0
+	})
+	for k, i := range ix.byFrom {
+		ix.maxTo[k] = &recs[i].ToIP
+		if k > 0 && ix.maxTo[k-1].Cmp(ix.maxTo[k]) > 0 {
+			ix.maxTo[k] = ix.maxTo[k-1]
+		}
+	}
+	return ix
+}
+
+//Of the ranges covering ip, the one starting last, which for nested ranges is
+//the innermost. The walk back stops once no earlier range reaches ip.
+func (ix *intervalIndex) find(recs []ip2locRec, ip *big.Int) (ip2locRec, bool) {
+	k := sort.Search(len(ix.byFrom), func(k int) bool { return recs[ix.byFrom[k]].FromIP.Cmp(ip) > 0 }) - 1
+	for ; k >= 0 && ix.maxTo[k].Cmp(ip) >= 0; k-- {
+		if rec := &recs[ix.byFrom[k]]; rec.ToIP.Cmp(ip) >= 0 {
+			return *rec, true
+		}
+	}
+	return ip2locRec{}, false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+//Of the records covering ip, the one starting last and, among those, ending
+//first: the innermost, as intervalIndex.find promises. recs need not be in
+//any order.
+func innermost(recs []ip2locRec, ip *big.Int) (ip2locRec, bool) {
+	var best *ip2locRec
+	for i := range recs {
+		rec := &recs[i]
+		if rec.FromIP.Cmp(ip) <= 0 && rec.ToIP.Cmp(ip) >= 0 && inner(rec, best) {
+			best = rec
+		}
+	}
+	if best == nil {
+		return ip2locRec{}, false
+	}
+	return *best, true
+}
+
+func inner(rec, best *ip2locRec) bool {
+	if best == nil {
+		return true
+	}
+	if c := rec.FromIP.Cmp(&best.FromIP); c != 0 {
+		return c > 0
+	}
+	return rec.ToIP.Cmp(&best.ToIP) < 0
+}
+
+func TestIntervalLookup(t *testing.T) {
+	tests := []struct {
+		name string
+		//In toIP order, as the cache holds them
+		recs         []ip2locRec
+		wantOverlaps bool
+	}{
+		{"gaps only", []ip2locRec{testRec(10, 19, "AU"), testRec(25, 29, "CN"), testRec(30, 30, "US"), testRec(50, 80, "DE")}, false},
+		{"nested", []ip2locRec{testRec(15, 17, "CN"), testRec(10, 30, "AU"), testRec(40, 50, "US")}, true},
+		{"overlapping with gaps", []ip2locRec{testRec(10, 20, "AU"), testRec(18, 30, "CN"), testRec(45, 60, "US"), testRec(50, 70, "DE"), testRec(80, 85, "FR")}, true},
+		{"shared start", []ip2locRec{testRec(10, 15, "CN"), testRec(10, 20, "AU"), testRec(25, 26, "US")}, true},
+		//A wide range before a narrow one that ends first: sorted by toIP,
+		//the narrow one comes first and the wide one ends after the gap
+		{"gap inside a wide range", []ip2locRec{testRec(30, 35, "CN"), testRec(10, 60, "AU"), testRec(70, 75, "US")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ix := buildIntervals(tt.recs)
+			if (ix != nil) != tt.wantOverlaps {
+				t.Fatalf("buildIntervals gave %v, want an index: %v", ix, tt.wantOverlaps)
+			}
+			view := cacheView{recs: tt.recs, intervals: ix}
+			for ip := int64(0); ip <= 90; ip++ {
+				n := big.NewInt(ip)
+				want, wantOK := innermost(tt.recs, n)
+				got, ok := view.lookup(n)
+				if ok != wantOK || got.CountryCode != want.CountryCode {
+					t.Errorf("lookup(%d) = %q, %v; want %q, %v", ip, got.CountryCode, ok, want.CountryCode, wantOK)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func ip2locLookup(w http.ResponseWriter, r *http.Request) *appError {
+	q := r.URL.Query().Get("ip")
+	if q == "" {
+		return &appError{errors.New("Missing ip parameter"), "Missing ip query parameter", 400}
+	}
+	ip, err := parseIP(q)
+	if err != nil {
+		return &appError{err, "Invalid ip query parameter", 400}
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+
+	rec, ok := view.lookup(ip)
+	if !ok {
+		return &appError{fmt.Errorf("No record covers ip %s", ip), "No IP2Location record found for ip", 404}
+	}
+	res := lookupResult{rec, rangeCIDRs(&rec.FromIP, &rec.ToIP)}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(&res); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
+	return nil
+}
+
+//The matched record and its range as CIDR blocks, so a client can cache the
+//answer for every address in the range
+type lookupResult struct {
+	rec   ip2locRec
+	cidrs []string
+}
+
+func (l lookupResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		FromIP string `json:"fromIP"`
+		ToIP   string `json:"toIP"`
+		*plainRec
+		CIDRs []string `json:"cidrs"`
+	}{l.rec.FromIP.String(), l.rec.ToIP.String(), (*plainRec)(&l.rec), l.cidrs})
+}
+
+//Geofence check: whether ?ip= falls in a range belonging to ?country=
+func ip2locContains(w http.ResponseWriter, r *http.Request) *appError {
+	q := r.URL.Query()
+	if q.Get("ip") == "" || q.Get("country") == "" {
+		return &appError{errors.New("Missing ip or country parameter"), "Both ip and country query parameters are required", 400}
+	}
+	ip, err := parseIP(q.Get("ip"))
+	if err != nil {
+		return &appError{err, "Invalid ip query parameter", 400}
+	}
+	code, e := parseCountry(q.Get("country"))
+	if e != nil {
+		return e
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+	rec, ok := view.lookup(ip)
+	res := struct {
+		Contains bool `json:"contains"`
+	}{ok && strings.EqualFold(rec.CountryCode, code)}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(&res); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
+	return nil
+}
+
+//Body is a JSON array of IP strings; the response maps each one to its record,
+//with the same range bounds and CIDRs as /lookup, or null when no range covers it
+func ip2locBulkLookup(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return &appError{fmt.Errorf("Method %s not allowed", r.Method), "Bulk lookup requires POST", 405}
+	}
+
+	//Generous for bulkMax IPv6 addresses, but stops oversized bodies being decoded
+	body := http.MaxBytesReader(w, r.Body, int64(cfg.bulkMax)*64+2)
+	var ips []string
+	if err := json.NewDecoder(body).Decode(&ips); err != nil {
+		return &appError{err, "Request body must be a JSON array of IP strings", 400}
+	}
+	if len(ips) > cfg.bulkMax {
+		return &appError{fmt.Errorf("Batch of %d exceeds %d", len(ips), cfg.bulkMax), fmt.Sprintf("Batch size exceeds the maximum of %d", cfg.bulkMax), 400}
+	}
+	nums := make([]*big.Int, len(ips))
+	for i, s := range ips {
+		ip, err := parseIP(s)
+		if err != nil {
+			return &appError{err, fmt.Sprintf("Invalid ip %q in request body", s), 400}
+		}
+		nums[i] = ip
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+
+	res := make(map[string]*lookupResult, len(ips))
+	for i, s := range ips {
+		if rec, ok := view.lookup(nums[i]); ok {
+			res[s] = &lookupResult{rec, rangeCIDRs(&rec.FromIP, &rec.ToIP)}
+		} else {
+			res[s] = nil
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
+	return nil
+}
+
+//Records are sorted by range end, so the first ToIP >= ip is the only candidate.
+//An ip equal to a record's ToIP belongs to that record. Unassigned ranges are
+//dropped by parser, so the candidate must also start at or below ip. That only
+//holds while ranges are disjoint; cacheView.lookup handles overlapping data.
+func lookup(recs []ip2locRec, ip *big.Int) (ip2locRec, bool) {
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].ToIP.Cmp(ip) >= 0 })
+	if i == len(recs) || recs[i].FromIP.Cmp(ip) > 0 {
+		return ip2locRec{}, false
+	}
+	return recs[i], true
+}
+
+//Accept a dotted-quad, an IPv6 address or the decimal form stored in the CSV
+func parseIP(s string) (*big.Int, error) {
+	if strings.Contains(s, ":") {
+		return ipv6ToBigInt(s)
+	}
+	if strings.Contains(s, ".") {
+		return ipv4ToBigInt(s)
+	}
+	ip, ok := new(big.Int).SetString(s, 10)
+	if !ok || ip.Sign() < 0 {
+		return nil, fmt.Errorf("Invalid ip: %q", s)
+	}
+	return ip, nil
+}
+
+func ipv4ToBigInt(s string) (*big.Int, error) {
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil, fmt.Errorf("Invalid IPv4 address %q: expected 4 octets, got %d", s, len(octets))
+	}
+	var n uint64
+	for _, o := range octets {
+		if o == "" {
+			return nil, fmt.Errorf("Invalid IPv4 address %q: empty octet", s)
+		}
+		v, err := strconv.ParseUint(o, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IPv4 address %q: octet %q is not a number in 0-255", s, o)
+		}
+		n = n<<8 | v
+	}
+	return new(big.Int).SetUint64(n), nil
+}
+
+//IPv4-mapped addresses (::ffff:1.2.3.4) produce the same integer as the raw IPv4
+func ipv6ToBigInt(s string) (*big.Int, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || !strings.Contains(s, ":") {
+		return nil, fmt.Errorf("Invalid IPv6 address %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4), nil
+	}
+	return new(big.Int).SetBytes(ip.To16()), nil
+}
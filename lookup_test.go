@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	//A gap between 200 and 300 where no range applies
+	recs := []ip2locRec{
+		testRec(0, 99, "AU"),
+		testRec(100, 199, "CN"),
+		testRec(300, 399, "US"),
+	}
+	tests := []struct {
+		ip      int64
+		country string
+	}{
+		{0, "AU"},
+		{99, "AU"},
+		{100, "CN"},
+		{150, "CN"},
+		{199, "CN"},
+		{200, ""},
+		{299, ""},
+		{300, "US"},
+		{399, "US"},
+		{400, ""},
+	}
+	for _, tt := range tests {
+		rec, ok := lookup(recs, big.NewInt(tt.ip))
+		if got := rec.CountryCode; ok != (tt.country != "") || got != tt.country {
+			t.Errorf("lookup(%d) = %q, %v; want %q", tt.ip, got, ok, tt.country)
+		}
+	}
+	if _, ok := lookup(nil, big.NewInt(1)); ok {
+		t.Error("lookup on no records found a match")
+	}
+}
+
+//Contiguous ranges of 16 addresses, like a dense IPv4 dataset
+func syntheticRecs(n int) []ip2locRec {
+	recs := make([]ip2locRec, n)
+	for i := range recs {
+		recs[i] = testRec(int64(i)*16, int64(i)*16+15, "US")
+	}
+	return recs
+}
+
+func linearLookup(recs []ip2locRec, ip *big.Int) (ip2locRec, bool) {
+	for i := range recs {
+		if recs[i].FromIP.Cmp(ip) <= 0 && recs[i].ToIP.Cmp(ip) >= 0 {
+			return recs[i], true
+		}
+	}
+	return ip2locRec{}, false
+}
+
+func TestLookupMatchesLinearScan(t *testing.T) {
+	recs := syntheticRecs(1000)
+	for ip := int64(0); ip < 16*1000+16; ip += 7 {
+		want, wantOK := linearLookup(recs, big.NewInt(ip))
+		got, ok := lookup(recs, big.NewInt(ip))
+		if ok != wantOK || got.ToIP.Cmp(&want.ToIP) != 0 {
+			t.Fatalf("lookup(%d) = %s, %v; linear scan gives %s, %v", ip, got.ToIP.String(), ok, want.ToIP.String(), wantOK)
+		}
+	}
+}
+
+//IPv6 editions keep IPv4 ranges at ::ffff:0:0/96, which a dotted-quad
+//lookup reaches the same as its mapped form
+func TestLookupMappedIPv4(t *testing.T) {
+	tests := []struct {
+		ip      string
+		country string
+	}{
+		{"1.0.0.5", "AU"},
+		{"::ffff:1.0.0.5", "AU"},
+		{"1.0.2.5", "CN"},
+		{"16778245", "US"},
+		{"2001:db8::1", "US"},
+		{"0.0.0.1", ""},
+		{"1.0.8.0", ""},
+		{"::1", ""},
+	}
+	for index := range lookupIndexes {
+		t.Run(index, func(t *testing.T) {
+			keepConfig(t)
+			freshCache(t)
+			cfg.file = filepath.Join("testdata", "mapped.csv")
+			cfg.lookupIndex = index
+			if _, e := cache.get(t.Context()); e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			view, _ := cache.snapshot()
+			if index == "trie" && view.trie == nil {
+				t.Fatal("No trie over the ::ffff:0:0/96 ranges")
+			}
+
+			for _, tt := range tests {
+				ip, err := parseIP(tt.ip)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rec, ok := view.lookup(ip)
+				if ok != (tt.country != "") || rec.CountryCode != tt.country {
+					t.Errorf("lookup(%s) = %q, %v; want %q", tt.ip, rec.CountryCode, ok, tt.country)
+				}
+			}
+		})
+	}
+}
+
+const benchRecs = 1 << 20
+
+func benchmarkLookup(b *testing.B, find func([]ip2locRec, *big.Int) (ip2locRec, bool)) {
+	recs := syntheticRecs(benchRecs)
+	//The last address of a range late in the data, the worst case for a scan
+	ip := new(big.Int).Set(&recs[benchRecs*3/4].ToIP)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := find(recs, ip); !ok {
+			b.Fatal("no match")
+		}
+	}
+}
+
+func BenchmarkLookupBinary(b *testing.B) {
+	benchmarkLookup(b, lookup)
+}
+
+func BenchmarkLookupLinear(b *testing.B) {
+	benchmarkLookup(b, linearLookup)
+}
+
+func TestIPv4ToBigInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0.0.0.0", "0"},
+		{"255.255.255.255", "4294967295"},
+		{"1.0.0.1", "16777217"},
+		{"8.8.8.8", "134744072"},
+	}
+	for _, tt := range tests {
+		got, err := ipv4ToBigInt(tt.in)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("ipv4ToBigInt(%q) = %v, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"1.2.3",
+		"1.2.3.4.5",
+		"256.0.0.1",
+		"1.2.3.-1",
+		"1.2..4",
+		"a.b.c.d",
+		"1.2.3.4 ",
+		"0x1.2.3.4",
+	} {
+		if got, err := ipv4ToBigInt(in); err == nil {
+			t.Errorf("ipv4ToBigInt(%q) = %v; want an error", in, got)
+		}
+	}
+}
+
+func TestIPv6ToBigInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		//Compressed and expanded forms of the same address
+		{"2001:4860:4860::8888", "42541956123769884636017138956568135816"},
+		{"2001:4860:4860:0000:0000:0000:0000:8888", "42541956123769884636017138956568135816"},
+		{"2001:4860:4860:0:0:0:0:8888", "42541956123769884636017138956568135816"},
+		{"::", "0"},
+		{"::1", "1"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "340282366920938463463374607431768211455"},
+		//Mixed notation with an embedded dotted quad
+		{"64:ff9b::192.0.2.33", "524413980667603649783483184533471777"},
+		//IPv4-mapped addresses give the raw IPv4 integer
+		{"::ffff:1.2.3.4", "16909060"},
+		{"::ffff:0102:0304", "16909060"},
+		{"0:0:0:0:0:ffff:1.2.3.4", "16909060"},
+	}
+	for _, tt := range tests {
+		got, err := ipv6ToBigInt(tt.in)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("ipv6ToBigInt(%q) = %v, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "1.2.3.4", "2001:db8::g", "2001:db8:::1", "1:2:3:4:5:6:7:8:9"} {
+		if got, err := ipv6ToBigInt(in); err == nil {
+			t.Errorf("ipv6ToBigInt(%q) = %v; want an error", in, got)
+		}
+	}
+}
+
+//parseIP picks the parser from the form of the address
+func TestParseIP(t *testing.T) {
+	v4, _ := parseIP("1.2.3.4")
+	mapped, _ := parseIP("::ffff:1.2.3.4")
+	decimal, _ := parseIP("16909060")
+	if v4 == nil || v4.Cmp(mapped) != 0 || v4.Cmp(decimal) != 0 {
+		t.Errorf("parseIP gave %v, %v and %v for the same address", v4, mapped, decimal)
+	}
+	for _, in := range []string{"-1", "zz", ""} {
+		if _, err := parseIP(in); err == nil {
+			t.Errorf("parseIP(%q) succeeded; want an error", in)
+		}
+	}
+}
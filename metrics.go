@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	requests      *prometheus.CounterVec
+	fetchErrors   prometheus.Counter
+	fetchDuration prometheus.Histogram
+	rowsRead      prometheus.Counter
+	parseErrors   prometheus.Counter
+	parseDuration prometheus.Histogram
+	records       prometheus.Gauge
+}
+
+//Registers every collector on reg; lastRefresh feeds the refresh age gauge
+func newMetrics(reg prometheus.Registerer, lastRefresh func() time.Time) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ip2loc_http_requests_total",
+			Help: "HTTP requests served, by status code and method.",
+		}, []string{"code", "method"}),
+		fetchErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ip2loc_fetch_errors_total",
+			Help: "Upstream fetches that failed after all retries.",
+		}),
+		fetchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ip2loc_fetch_duration_seconds",
+			Help:    "Time to download the dataset from upstream, including retries.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		}),
+		rowsRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ip2loc_csv_rows_read_total",
+			Help: "CSV rows read from the dataset.",
+		}),
+		parseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ip2loc_parse_errors_total",
+			Help: "Loads aborted because the data could not be read or parsed.",
+		}),
+		parseDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ip2loc_parse_duration_seconds",
+			Help:    "Time to fetch, read and parse the dataset.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		}),
+		records: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ip2loc_records",
+			Help: "Records in the cached dataset.",
+		}),
+	}
+	reg.MustRegister(m.requests, m.fetchErrors, m.fetchDuration, m.rowsRead, m.parseErrors, m.parseDuration, m.records,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ip2loc_last_refresh_age_seconds",
+			Help: "Seconds since the dataset was last loaded, -1 before the first load.",
+		}, func() float64 {
+			t := lastRefresh()
+			if t.IsZero() {
+				return -1
+			}
+			return time.Since(t).Seconds()
+		}))
+	return m
+}
+
+//The registry /metrics serves and the collectors the call sites update. Set
+//together by useMetrics, so a test can count on an empty registry of its own.
+var (
+	metricsRegistry *prometheus.Registry
+	mtr             *metrics
+)
+
+func init() {
+	useMetrics(prometheus.NewRegistry())
+}
+
+//Serves metricsRegistry uncompressed: gzipHandler already compresses for
+//clients that ask, and promhttp doing so too would encode the body twice
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{DisableCompression: true})
+}
+
+//Points /metrics and every call site at fresh collectors on reg. The refresh
+//age reads whichever cache is current when scraped.
+func useMetrics(reg *prometheus.Registry) {
+	metricsRegistry = reg
+	mtr = newMetrics(reg, func() time.Time { return cache.lastRefresh() })
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//The value /metrics reports for series, a metric name with any labels as
+//they appear in the exposition format. Fails the test if it is missing.
+func metricValue(t testing.TB, series string) float64 {
+	t.Helper()
+	rr := get(metricsHandler(), "/metrics")
+	sc := bufio.NewScanner(rr.Body)
+	for sc.Scan() {
+		v, ok := strings.CutPrefix(sc.Text(), series+" ")
+		if !ok {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			t.Fatalf("Series %s has value %q: %v", series, v, err)
+		}
+		return f
+	}
+	t.Fatalf("No series %s in /metrics:\n%s", series, rr.Body)
+	return 0
+}
+
+func TestMetricsCountLoads(t *testing.T) {
+	freshMetrics(t)
+	useTestData(t)
+	h := promhttp.InstrumentHandlerCounter(mtr.requests, appHandler(ip2locLookup))
+
+	if got := metricValue(t, "ip2loc_last_refresh_age_seconds"); got != -1 {
+		t.Errorf("Refresh age %v before any load, want -1", got)
+	}
+	for _, ip := range []string{"1.0.0.5", "1.0.2.5", "9.9.9.9"} {
+		get(h, "/lookup?ip="+ip)
+	}
+	want := map[string]float64{
+		`ip2loc_http_requests_total{code="200",method="get"}`: 2,
+		`ip2loc_http_requests_total{code="404",method="get"}`: 1,
+		"ip2loc_records":                      3,
+		"ip2loc_csv_rows_read_total":          4,
+		"ip2loc_parse_duration_seconds_count": 1,
+		"ip2loc_fetch_duration_seconds_count": 1,
+		"ip2loc_fetch_errors_total":           0,
+		"ip2loc_parse_errors_total":           0,
+	}
+	for series, v := range want {
+		if got := metricValue(t, series); got != v {
+			t.Errorf("%s = %v, want %v", series, got, v)
+		}
+	}
+	if got := metricValue(t, "ip2loc_last_refresh_age_seconds"); got < 0 {
+		t.Errorf("Refresh age %v after a load, want at least 0", got)
+	}
+}
+
+func TestMetricsCountFailures(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", 500)
+	}))
+	t.Cleanup(failing.Close)
+	tests := []struct {
+		name   string
+		setup  func(t testing.TB)
+		series string
+	}{
+		{"fetch", func(t testing.TB) { useUpstream(t, failing.URL) }, "ip2loc_fetch_errors_total"},
+		{"parse", func(t testing.TB) {
+			useUpstream(t, testUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV+"\"oops\",\"1\",\"US\",\"-\",\"-\",\"-\"\n")).URL)
+		}, "ip2loc_parse_errors_total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			freshMetrics(t)
+			tt.setup(t)
+			get(appHandler(ip2locLookup), "/lookup?ip=1.0.0.5")
+			if got := metricValue(t, tt.series); got != 1 {
+				t.Errorf("%s = %v after one failed load, want 1", tt.series, got)
+			}
+			if got := metricValue(t, "ip2loc_records"); got != 0 {
+				t.Errorf("ip2loc_records = %v after a failed load, want 0", got)
+			}
+		})
+	}
+}
+
+//Through the server's middleware a scrape asking for gzip is compressed once,
+//by gzipHandler, and gunzips to the plain exposition format
+func TestMetricsGzipOnce(t *testing.T) {
+	freshMetrics(t)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := serveRequest(middleware(mux), req)
+	if rr.Code != 200 {
+		t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "ip2loc_records ") {
+		t.Errorf("Body does not gunzip to the exposition format:\n%q", body)
+	}
+}
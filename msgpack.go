@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//Record as packed for ?format=msgpack, with the same keys as the JSON output.
+//IPs stay decimal strings so clients need no 128-bit integer type.
+type msgpackRec struct {
+	FromIP      string  `msgpack:"fromIP"`
+	ToIP        string  `msgpack:"toIP"`
+	CountryCode string  `msgpack:"countryCode"`
+	CountryName string  `msgpack:"countryName"`
+	Region      string  `msgpack:"region"`
+	City        string  `msgpack:"city"`
+	Latitude    float64 `msgpack:"latitude"`
+	Longitude   float64 `msgpack:"longitude"`
+}
+
+//A stream of concatenated msgpack maps, one per record, which msgpack
+//decoders read back one value at a time
+type msgpackEncoder struct {
+	enc *msgpack.Encoder
+}
+
+func newMsgpackEncoder(w io.Writer) *msgpackEncoder {
+	return &msgpackEncoder{msgpack.NewEncoder(w)}
+}
+
+func (e *msgpackEncoder) Encode(rec *ip2locRec) error {
+	return e.enc.Encode(&msgpackRec{
+		FromIP:      rec.FromIP.String(),
+		ToIP:        rec.ToIP.String(),
+		CountryCode: rec.CountryCode,
+		CountryName: rec.CountryName,
+		Region:      rec.Region,
+		City:        rec.City,
+		Latitude:    rec.Latitude,
+		Longitude:   rec.Longitude,
+	})
+}
+
+func (e *msgpackEncoder) Close() error {
+	return nil
+}
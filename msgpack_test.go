@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//?format=msgpack decodes, map by map, to the same keys and values as the
+//JSON output
+func TestMsgpackMatchesJSON(t *testing.T) {
+	warmCoordData(t)
+
+	rr := get(appHandler(ip2locInit), "/?format=json-array")
+	if rr.Code != 200 {
+		t.Fatalf("JSON status %d: %s", rr.Code, rr.Body)
+	}
+	var want []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = get(appHandler(ip2locInit), "/?format=msgpack")
+	if rr.Code != 200 {
+		t.Fatalf("Msgpack status %d: %s", rr.Code, rr.Body)
+	}
+	dec := msgpack.NewDecoder(bytes.NewReader(rr.Body.Bytes()))
+	var got []map[string]any
+	for {
+		var m map[string]any
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Record %d: %v", len(got), err)
+		}
+		got = append(got, m)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Decoded %d records, want the %d JSON has", len(got), len(want))
+	}
+	for i := range got {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("Record %d decoded as %v, want %v", i, got[i], want[i])
+		}
+	}
+}
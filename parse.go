@@ -3,17 +3,36 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
+	"log/slog"
 	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
+//Guards supportedCountries, which /countries/ changes at runtime
+var supportedMu sync.RWMutex
+
 var supportedCountries = map[string]struct{}{
 	"AU": struct{}{},
 	"CA": struct{}{},
@@ -21,15 +40,21 @@ var supportedCountries = map[string]struct{}{
 	"US": struct{}{},
 }
 
-//Closing cancel channel signals reader or parser functions ending prematurely
-var cancel chan struct{}
-var done chan struct{}
+//Fields a row needs to hold every mapped column. The defaults follow
+//IPV6-COUNTRY-REGION-CITY.CSV: fromIP, toIP, country code, country name, region, city.
+func recFields() int {
+	return max(cfg.colFrom, cfg.colIP, cfg.colCountry, cfg.colRegion, cfg.colCity) + 1
+}
 
 type ip2locRec struct {
+	FromIP      big.Int `json:"fromIP"`
 	ToIP        big.Int `json:"toIP"`
 	CountryCode string  `json:"countryCode"`
+	CountryName string  `json:"countryName"`
 	Region      string  `json:"region"`
 	City        string  `json:"city"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
 }
 
 type appError struct {
@@ -40,146 +65,903 @@ type appError struct {
 
 type appHandler func(http.ResponseWriter, *http.Request) *appError
 
+//Streams that stay open on purpose, so -request-timeout doesn't cut them off
+var untimedPaths = map[string]struct{}{
+	"/progress": struct{}{},
+}
+
+//Handlers run under -request-timeout, which cancels any fetch and parse the
+//request is waiting on; a handler failing because it fired answers 504
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if e := fn(w, r); e != nil {
-		fmt.Printf("%v\n%s\n", e.Error, e.Message)
+	if _, ok := untimedPaths[r.URL.Path]; !ok && cfg.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	e := fn(w, r)
+	if e != nil && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		e = &appError{e.Error, "Request timed out", 504}
+	}
+	if e != nil {
+		logger.Error(e.Message, "requestID", requestID(r.Context()), "error", e.Error, "status", e.Code)
 		http.Error(w, e.Message, e.Code)
 	}
 }
 
 func main() {
-	http.Handle("/", appHandler(ip2locInit))
-	http.ListenAndServe(":3000", nil)
+	//Route the log package through the same JSON handler
+	slog.SetDefault(logger)
+
+	//serve is the default so existing invocations with only flags keep working
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	if err := parseFlags(cmd, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	switch cmd {
+	case "serve":
+		serve()
+	case "parse":
+		os.Exit(runParse())
+	case "sqlite":
+		os.Exit(runSQLite())
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q: expected serve, parse or sqlite\n", cmd)
+		os.Exit(2)
+	}
 }
 
-func ip2locInit(w http.ResponseWriter, r *http.Request) *appError {
-	var recs []ip2locRec
+//Wraps every route in the server's logging, tracing, metrics, CORS, rate
+//limiting, compression and auth, outermost first
+func middleware(h http.Handler) http.Handler {
+	return requestLog(traceRequests(promhttp.InstrumentHandlerCounter(mtr.requests, cors(rateLimit(gzipHandler(requireAPIKey(datasetDateHeader(h))))))))
+}
+
+func serve() {
+	http.Handle("/", appHandler(ip2locInit))
+	http.Handle("/lookup", appHandler(ip2locLookup))
+	http.Handle("/lookup/bulk", appHandler(ip2locBulkLookup))
+	http.Handle("/contains", appHandler(ip2locContains))
+	http.Handle("/countries", appHandler(ip2locCountries))
+	http.Handle("/countries/", appHandler(ip2locCountry))
+	http.Handle("/distinct", appHandler(ip2locDistinct))
+	http.Handle("/diff", appHandler(ip2locDiff))
+	http.Handle("/progress", appHandler(ip2locProgress))
+	http.Handle("/ranges", appHandler(ip2locRanges))
+	http.Handle("/refresh", appHandler(ip2locRefresh))
+	http.Handle("/search", appHandler(ip2locSearch))
+	http.Handle("/stats", appHandler(ip2locStats))
+	http.Handle("/validate", appHandler(ip2locValidate))
+	http.Handle("/metrics", metricsHandler())
+	http.HandleFunc("/health", health)
+	http.HandleFunc("/ready", ready)
 
-	if b, rl, err := fetch("http://127.0.0.1:4000"); err != nil {
-		return &appError{err, "Error fetching IP2Location data from IP2Location server", 404}
+	//Cancelled once shutdown finishes so parses still running are abandoned
+	base, cancelBase := context.WithCancel(context.Background())
+	cache.ctx = base
+	shutdownTracing, err := initTracing(base)
+	if err != nil {
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+	server := &http.Server{
+		Addr:        cfg.addr,
+		Handler:     middleware(http.DefaultServeMux),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+
+	//Load the pair now so a bad certificate stops startup rather than failing
+	//every handshake
+	if cfg.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if cfg.eager {
+		go cache.preload(base)
+	}
+	if cfg.refresh > 0 {
+		go cache.refreshEvery(base, cfg.refresh)
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("Listening on %s (HTTPS)", cfg.addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Listening on %s", cfg.addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if cfg.grpcAddr != "" {
+		lis, err := net.Listen("tcp", cfg.grpcAddr)
+		if err != nil {
+			log.Fatalf("Error listening for gRPC: %v", err)
+		}
+		grpcServer = newGRPCServer()
+		go func() {
+			log.Printf("gRPC listening on %s", cfg.grpcAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	<-sigs
+
+	log.Printf("Shutting down, draining requests for up to %s", cfg.shutdownGrace)
+	ctx, cancelGrace := context.WithTimeout(context.Background(), cfg.shutdownGrace)
+	defer cancelGrace()
+	//GracefulStop waits on open streams with no deadline of its own, so Stop
+	//cuts off any still running once the grace period is spent
+	grpcStopped := make(chan struct{})
+	if grpcServer != nil {
+		stop := context.AfterFunc(ctx, grpcServer.Stop)
+		defer stop()
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
 	} else {
-		line := make(chan []string, 500000)
-		chErr := make(chan error)
+		close(grpcStopped)
+	}
+	err = server.Shutdown(ctx)
+	<-grpcStopped
+	cancelBase()
+	if terr := shutdownTracing(ctx); terr != nil {
+		log.Printf("Error flushing traces: %v", terr)
+	}
+	if err != nil {
+		log.Printf("Shutdown grace period expired: %v", err)
+		server.Close()
+		os.Exit(1)
+	}
+	log.Print("Shutdown complete")
+}
 
-		cancel = make(chan struct{})
-		done = make(chan struct{})
+func ip2locInit(w http.ResponseWriter, r *http.Request) *appError {
+	format, e := outputFormat(r)
+	if e != nil {
+		return e
+	}
+	filter, e := parseFilter(r)
+	if e != nil {
+		return e
+	}
+	pg, e := parsePage(r)
+	if e != nil {
+		return e
+	}
 
-		//Read new lines as previous lines are being parsed
-		go reader(b, rl, line, chErr)
-		go parser(&recs, line, chErr)
+	//Serve only complete data; a cold cache starts loading in the background.
+	//With none running, the last one's failure answers rather than a 503.
+	view, warm := cache.snapshot()
+	if !warm {
+		e := cache.loadError()
+		cache.prime()
+		if e != nil {
+			return e
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(loadingRetryAfter))
+		return &appError{errLoading, "IP2Location data is still loading", 503}
+	}
+	etag := datasetETag(view.loadedAt, r)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 
-		select {
-		case e := <-chErr:
-			return &appError{e, "Error preparing IP2Location data", 404}
-		case <-done:
+	//A country filter only needs to look at that country's records
+	recs := view.recs
+	idx := filter.candidates(view.byCountry)
+	size := len(recs)
+	if idx != nil {
+		size = len(idx)
+	}
+	at := func(k int) *ip2locRec {
+		if idx == nil {
+			return &recs[k]
+		}
+		return &recs[idx[k]]
+	}
+
+	total := 0
+	for k := 0; k < size; k++ {
+		if filter.match(at(k)) {
+			total++
 		}
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.Header().Set("Recs-Total", strconv.Itoa(total))
+	w.Header().Set("Recs-Length", strconv.Itoa(pg.length(total)))
 
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Recs-Length", strconv.Itoa(len(recs)))
-		e := json.NewEncoder(w)
-		for _, v := range recs {
-			if err = e.Encode(&v); err != nil {
-				return &appError{err, "Error marshalling IP2Location data", 404}
+	//Flush every batch so large dumps go out as chunks while encoding
+	//continues. The deferred flush also sends what was encoded before an error.
+	bw := newDumpWriter(w)
+	defer bw.Flush()
+	enc := newRecEncoder(format, bw)
+	n, skip := 0, pg.offset
+	for k := 0; k < size; k++ {
+		rec := at(k)
+		if !filter.match(rec) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if pg.limit >= 0 && n == pg.limit {
+			break
+		}
+		if err := enc.Encode(rec); err != nil {
+			return &appError{err, "Error marshalling IP2Location data", 500}
+		}
+		n++
+		if n%parseBatch == 0 {
+			if err := bw.Flush(); err != nil {
+				return &appError{err, "Error writing IP2Location data", 500}
 			}
 		}
 	}
+	if err := enc.Close(); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
 	return nil
 }
 
-func fetch(url string) ([]byte, int64, error) {
-	timeout := time.Duration(180 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+//What a load produced besides the records
+type loadResult struct {
+	//Identifies the version that was loaded
+	version validators
+	//Release date of the data, zero if it gives none
+	date    time.Time
+	skipped skipReport
+}
+
+//Rows dropped under -lenient: how many, and the errors for the first few
+type skipReport struct {
+	count  int
+	sample []string
+}
+
+//Errors kept per load for /stats; the rest are only counted
+const skipSampleSize = 10
+
+func (s *skipReport) add(err error) {
+	s.count++
+	if len(s.sample) < skipSampleSize {
+		s.sample = append(s.sample, strings.TrimSpace(err.Error()))
 	}
-	res, err := client.Get(url)
+}
+
+var (
+	parseSemOnce sync.Once
+	parseSem     chan struct{}
+)
+
+//Slots for loads running at once, sized by -max-parses on first use. The
+//cache already shares one load between its callers; this also bounds dry
+//runs from /validate and refreshes that overlap a slow load, each of which
+//holds a full dataset in memory.
+func parseSlots() chan struct{} {
+	parseSemOnce.Do(func() {
+		parseSem = make(chan struct{}, cfg.maxParses)
+	})
+	return parseSem
+}
+
+//Fetch and parse the IP2Location data, passing each record to emit as soon as
+//it is parsed. Cancelling ctx stops the reader and parser, or the wait for a
+//free -max-parses slot. The result's validators identify the version that was
+//loaded; when upstream reports the version in cond is unchanged, the error
+//wraps errNotModified.
+func load(ctx context.Context, cond validators, emit func(*ip2locRec)) (loadResult, *appError) {
+	return loadFrom(ctx, openSource, progress, cond, emit)
+}
+
+//Opens the data a load parses
+type sourceFunc func(ctx context.Context, cond validators) (*dataFile, error)
+
+//load with the data from open instead of -file or -upstream, reporting to
+//prog, or to nobody when it is nil
+func loadFrom(ctx context.Context, open sourceFunc, prog *progressBroker, cond validators, emit func(*ip2locRec)) (res loadResult, e *appError) {
+	slots := parseSlots()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return loadResult{version: cond}, &appError{ctx.Err(), "Cancelled while waiting for another load to finish", 503}
+	}
+	defer func() { <-slots }()
+
+	//Cancelled by reader or parser on error so the other one stops too
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	prog.start()
+	emitted := 0
+	defer func() {
+		var err error
+		if e != nil && e.Error != errNotModified {
+			err = errors.New(e.Message)
+		}
+		prog.finish(emitted, err)
+	}()
+
+	start := time.Now()
+	defer func() { mtr.parseDuration.Observe(time.Since(start).Seconds()) }()
+
+	fetchCtx, fetchSpan := tracer.Start(ctx, "fetch", trace.WithAttributes(attribute.Bool("ip2loc.file", cfg.file != "")))
+	d, err := open(fetchCtx, cond)
+	if err == errNotModified {
+		fetchSpan.SetAttributes(attribute.Bool("ip2loc.not_modified", true))
+		fetchSpan.End()
+		return loadResult{version: cond}, &appError{err, "IP2Location data not modified", 304}
+	}
+	endSpan(fetchSpan, err)
 	if err != nil {
-		return []byte{}, 0, err
+		if cfg.file != "" {
+			return loadResult{version: cond}, &appError{err, "Error opening IP2Location data file", 500}
+		}
+		return loadResult{version: cond}, &appError{err, "Error fetching IP2Location data from IP2Location server", 502}
+	}
+	fetchSpan.SetAttributes(attribute.Int64("ip2loc.bytes", d.size))
+	res = loadResult{version: d.validators, date: dataDate(d)}
+
+	line := make(chan csvRow, cfg.buffer)
+	recs := make(chan ip2locRec, 1024)
+	//One slot per producer (reader and parser), so reporting an error never
+	//blocks even once load has stopped listening
+	chErr := make(chan error, 2)
+
+	//Returning stops reader and parser and waits for them to exit, so nothing
+	//from this load outlives its -max-parses slot
+	var producers sync.WaitGroup
+	defer func() {
+		stop()
+		producers.Wait()
+	}()
+
+	//Read new lines as previous lines are being parsed
+	producers.Add(2)
+	go func() {
+		defer producers.Done()
+		defer d.Close()
+		reader(ctx, stop, d, d.size, line, chErr)
+	}()
+	//Only parser touches skips until it closes recs, which may be after an
+	//error has ended the load. It is copied into res once recs is closed.
+	skips := new(skipReport)
+	//Ends with the load, so it covers parsing and handing records to emit
+	_, parseSpan := tracer.Start(ctx, "parse")
+	defer func() {
+		parseSpan.SetAttributes(attribute.Int("ip2loc.records", emitted), attribute.Int("ip2loc.skipped", res.skipped.count))
+		var err error
+		if e != nil && e.Error != errNotModified {
+			err = e.Error
+		}
+		endSpan(parseSpan, err)
+	}()
+	go func() {
+		defer producers.Done()
+		parser(ctx, stop, line, recs, chErr, skips, prog)
+	}()
+
+	failed := func(e error) (loadResult, *appError) {
+		mtr.parseErrors.Inc()
+		if errors.Is(e, errEmptyZip) {
+			if cfg.file != "" {
+				return loadResult{version: cond}, &appError{e, "IP2Location data file is an empty zip", 500}
+			}
+			return loadResult{version: cond}, &appError{e, "IP2Location server sent an empty zip", 502}
+		}
+		var se sourceError
+		if errors.As(e, &se) && cfg.file == "" {
+			return loadResult{version: cond}, &appError{e, "Invalid IP2Location data from IP2Location server", 502}
+		}
+		return loadResult{version: cond}, &appError{e, "Error preparing IP2Location data", 500}
 	}
+	for {
+		select {
+		case e := <-chErr:
+			return failed(e)
+		case <-ctx.Done():
+			//A producer reports its error before calling stop, so prefer it
+			//to the cancellation it caused
+			select {
+			case e := <-chErr:
+				return failed(e)
+			default:
+			}
+			return loadResult{version: cond}, &appError{ctx.Err(), "Cancelled while preparing IP2Location data", 503}
+		case rec, ok := <-recs:
+			if !ok {
+				//parser closes recs right after reporting an error
+				select {
+				case e := <-chErr:
+					return failed(e)
+				default:
+				}
+				res.skipped = *skips
+				return res, nil
+			}
+			emit(&rec)
+			emitted++
+		}
+	}
+}
+
+//A problem with the data itself, such as a corrupt zip or a missing CSV,
+//rather than with this process
+type sourceError struct {
+	error
+}
+
+func (e sourceError) Unwrap() error {
+	return e.error
+}
 
-	b, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+//A well-formed zip with no members, told apart from one lacking the CSV as
+//it points at a broken upstream export rather than a renamed file
+var errEmptyZip = errors.New("Zip archive is empty")
+
+//Zip local file header signature, the end of central directory signature an
+//empty zip starts with, and gzip member header; anything else is treated as
+//a raw CSV
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+)
+
+//Values accepted by -archive
+var archiveKinds = map[string]struct{}{
+	"auto": struct{}{},
+	"zip":  struct{}{},
+	"gzip": struct{}{},
+	"csv":  struct{}{},
+}
+
+func reader(ctx context.Context, stop context.CancelFunc, body io.ReaderAt, size int64, out chan<- csvRow, abort chan<- error) {
+	defer close(out)
+	//Covers opening the archive and splitting the CSV into rows
+	_, span := tracer.Start(ctx, "read", trace.WithAttributes(attribute.String("ip2loc.archive", archiveKind(body)), attribute.Int64("ip2loc.bytes", size)))
+	var rows int
+	var err error
+	defer func() {
+		span.SetAttributes(attribute.Int("ip2loc.rows", rows))
+		endSpan(span, err)
+	}()
+
+	rc, err := openCSV(body, size)
 	if err != nil {
-		return []byte{}, 0, err
+		abort <- err
+		stop()
+		return
+	}
+	//Closed as soon as the rows are read, including on error or cancellation
+	rows, err = readCSV(ctx, rc, out)
+	rc.Close()
+	if err != nil {
+		abort <- err
+		stop()
 	}
-	return b, res.ContentLength, nil
 }
 
-//Stop reader or parser if the other process was cancelled
-func cancelled() bool {
-	select {
-	case <-cancel:
+//-archive, or when it is auto the type the leading bytes of body suggest
+func archiveKind(body io.ReaderAt) string {
+	if cfg.archive != "auto" {
+		return cfg.archive
+	}
+	magic := make([]byte, len(zipMagic))
+	n, _ := body.ReadAt(magic, 0)
+	switch {
+	case bytes.Equal(magic[:n], zipMagic), bytes.Equal(magic[:n], emptyZipMagic):
+		return "zip"
+	case bytes.HasPrefix(magic[:n], gzipMagic):
+		return "gzip"
+	}
+	return "csv"
+}
+
+//The uncompressed CSV inside body. Zips are read in place through
+//io.ReaderAt, with archive/zip resolving zip64 sizes and offsets, so memory
+//use does not grow with the archive: only the central directory is held and
+//the member is decompressed as it streams. Archives over 4GB work as long as
+//-max-download allows them.
+func openCSV(body io.ReaderAt, size int64) (io.ReadCloser, error) {
+	switch archiveKind(body) {
+	case "csv":
+		return io.NopCloser(io.NewSectionReader(body, 0, size)), nil
+	case "gzip":
+		//A .csv.gz: one compressed CSV with no zip layer
+		gz, err := gzip.NewReader(io.NewSectionReader(body, 0, size))
+		if err != nil {
+			return nil, sourceError{err}
+		}
+		return gz, nil
+	}
+
+	zipPack, err := zip.NewReader(body, size)
+	if err != nil {
+		return nil, sourceError{err}
+	}
+	if len(zipPack.File) == 0 {
+		return nil, sourceError{errEmptyZip}
+	}
+	f := csvMember(zipPack.File, cfg.csvName)
+	if f == nil {
+		return nil, sourceError{fmt.Errorf("No CSV file in zip: expected %s or another *.CSV member", cfg.csvName)}
+	}
+	return openMember(f)
+}
+
+//When the data was released: the CSV member's modification time in a zip,
+//the header's in a gzip, otherwise upstream's Last-Modified. IP2Location's
+//file names carry no date. Zero when none of these is set.
+func dataDate(d *dataFile) time.Time {
+	var t time.Time
+	switch archiveKind(d) {
+	case "zip":
+		if zipPack, err := zip.NewReader(d, d.size); err == nil {
+			if f := csvMember(zipPack.File, cfg.csvName); f != nil {
+				t = f.Modified
+			}
+		}
+	case "gzip":
+		if gz, err := gzip.NewReader(io.NewSectionReader(d, 0, d.size)); err == nil {
+			t = gz.ModTime
+			gz.Close()
+		}
+	}
+	if t.IsZero() && d.validators.lastModified != "" {
+		t, _ = http.ParseTime(d.validators.lastModified)
+	}
+	if t.IsZero() {
+		return t
+	}
+	return t.UTC()
+}
+
+//The member called name, falling back to the first *.CSV in case IP2Location
+//renames the file
+func csvMember(files []*zip.File, name string) *zip.File {
+	for _, f := range files {
+		if f.Name == name {
+			return f
+		}
+	}
+	for _, f := range files {
+		if strings.EqualFold(path.Ext(f.Name), ".csv") {
+			log.Printf("%s not found in zip, reading %s instead", name, f.Name)
+			return f
+		}
+	}
+	return nil
+}
+
+//A CSV record and the line of the file it starts on, 1-based, so errors
+//point at the right line after a skipped header or a quoted line break
+type csvRow struct {
+	fields []string
+	line   int
+}
+
+//Send every row of r on out. Returns nil at EOF or once ctx is cancelled.
+//Returns the number of rows read, including any header
+func readCSV(ctx context.Context, rc io.Reader, out chan<- csvRow) (rows int, err error) {
+	r := csv.NewReader(rc)
+	r.Comma = cfg.delimiter
+	//Records not required to have a certain number of fields
+	r.FieldsPerRecord = -1
+
+	for first := true; ; first = false {
+		if ctx.Err() != nil {
+			return rows, nil
+		}
+		rec, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows++
+		mtr.rowsRead.Inc()
+		if first && isHeader(rec) {
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		select {
+		case out <- csvRow{rec, line}:
+		case <-ctx.Done():
+			return rows, nil
+		}
+	}
+}
+
+//Whether the first row of a CSV is a header rather than data, per -skip-header
+func isHeader(rec []string) bool {
+	switch cfg.skipHeader {
+	case "true":
 		return true
-	default:
+	case "false":
 		return false
 	}
+	//auto: data rows hold the range bounds as integers
+	for _, col := range []int{cfg.colFrom, cfg.colIP} {
+		if col >= len(rec) {
+			continue
+		}
+		if _, ok := new(big.Int).SetString(rec[col], 10); !ok {
+			return true
+		}
+	}
+	return false
 }
 
-func reader(body []byte, resLen int64, out chan<- []string, abort chan<- error) {
+//Rows are parsed in batches so workers don't contend on a channel per row
+const parseBatch = 1024
+
+type rowBatch struct {
+	seq  int
+	rows []csvRow
+}
+
+type recBatch struct {
+	seq  int
+	recs []ip2locRec
+	//CSV line (1-based) each record starts on
+	lines []int
+	//Bad rows passed over under -lenient
+	skipped []error
+	err     error
+}
+
+//Parses rows on cfg.workers goroutines and emits records in CSV order.
+//Closing out without an error on abort means every record was parsed, apart
+//from the rows -lenient added to skips. The count so far goes to prog.
+func parser(ctx context.Context, stop context.CancelFunc, in <-chan csvRow, out chan<- ip2locRec, abort chan<- error, skips *skipReport, prog *progressBroker) {
 	defer close(out)
+	//The goroutines below exit once in is drained or ctx is cancelled, as it
+	//is before any early return. Deferred ahead of the recover below, so a
+	//panic calls stop before this waits.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	//parseRows recovers on the workers; this covers the batching and collecting
+	defer func() {
+		if p := recover(); p != nil {
+			abort <- fmt.Errorf("Panic in parser: %v", p)
+			stop()
+		}
+	}()
 
-	zipPack, err := zip.NewReader(bytes.NewReader(body), resLen)
-	if err != nil {
-		abort <- err
-		close(cancel)
-		return
+	workers := cfg.workers
+	if workers < 1 {
+		workers = 1
 	}
+	jobs := make(chan rowBatch, workers)
+	results := make(chan recBatch, workers)
 
-	for _, f := range zipPack.File {
-		if f.Name == "IPV6-COUNTRY-REGION-CITY.CSV" {
-			rc, err := f.Open()
-			if err != nil {
-				abort <- err
-				close(cancel)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		b := rowBatch{}
+		for {
+			//Watching ctx too means a cancelled parser never waits on in
+			var v csvRow
+			var ok bool
+			select {
+			case v, ok = <-in:
+			case <-ctx.Done():
 				return
 			}
-			defer rc.Close()
-
-			r := csv.NewReader(rc)
-			//Records not required to have a certain number of fields
-			r.FieldsPerRecord = -1
+			if !ok {
+				break
+			}
+			b.rows = append(b.rows, v)
+			if len(b.rows) < parseBatch {
+				continue
+			}
+			select {
+			case jobs <- b:
+			case <-ctx.Done():
+				return
+			}
+			b = rowBatch{seq: b.seq + 1}
+		}
+		if len(b.rows) > 0 {
+			select {
+			case jobs <- b:
+			case <-ctx.Done():
+			}
+		}
+	}()
 
-			for {
-				if cancelled() {
+	var busy sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		busy.Add(1)
+		go func() {
+			defer busy.Done()
+			for b := range jobs {
+				select {
+				case results <- parseRows(b):
+				case <-ctx.Done():
 					return
 				}
-				rec, err := r.Read()
-				if err == io.EOF {
-					break
+			}
+		}()
+	}
+	//Waiting on this one covers the workers too
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		busy.Wait()
+		close(results)
+	}()
+
+	//Batches finish out of order; hold them until their turn
+	pending := make(map[int]recBatch)
+	next := 0
+	var prev *big.Int
+	parsed, published := 0, time.Now()
+	for res := range results {
+		pending[res.seq] = res
+		for b, ok := pending[next]; ok; b, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if b.err != nil {
+				abort <- b.err
+				stop()
+				return
+			}
+			for _, err := range b.skipped {
+				skips.add(err)
+			}
+			parsed += len(b.recs)
+			if time.Since(published) >= progressInterval {
+				prog.publish(parsed)
+				published = time.Now()
+			}
+			for i, rec := range b.recs {
+				//Lookups binary search on ToIP, so catch a reordered download here
+				if cfg.strictOrder {
+					if prev != nil && rec.ToIP.Cmp(prev) <= 0 {
+						abort <- sourceError{fmt.Errorf("Record on line %d out of order: toIP %s does not follow %s", b.lines[i], rec.ToIP.String(), prev)}
+						stop()
+						return
+					}
+					prev = &b.recs[i].ToIP
 				}
-				if err != nil {
-					abort <- err
-					close(cancel)
+				select {
+				case out <- rec:
+				case <-ctx.Done():
 					return
 				}
-				out <- rec
 			}
 		}
 	}
 }
 
-func parser(ipRecs *[]ip2locRec, in <-chan []string, abort chan<- error) {
-	for v := range in {
-		if cancelled() {
-			return
+//Stops at the first bad row, keeping the records before it, unless -lenient
+//is set. A panic on a row becomes that row's error rather than taking the
+//process down.
+func parseRows(b rowBatch) (res recBatch) {
+	res = recBatch{seq: b.seq, recs: make([]ip2locRec, 0, len(b.rows))}
+	var v []string
+	defer func() {
+		if p := recover(); p != nil {
+			res.err = fmt.Errorf("Panic parsing record %v: %v", v, p)
 		}
-		ipNum := big.NewInt(0)
-		if _, ok := ipNum.SetString(v[1], 10); !ok {
-			abort <- fmt.Errorf("Error with record: %v\n", v)
-			close(cancel)
-			return
-		}
-		if v[2] == "-" {
+	}()
+	for _, row := range b.rows {
+		v = row.fields
+		rec, ok, err := parseRow(v)
+		if err != nil && cfg.lenient {
+			res.skipped = append(res.skipped, fmt.Errorf("Line %d: %v", row.line, err))
 			continue
 		}
-		rec := ip2locRec{
-			ToIP:        *ipNum,
-			CountryCode: v[2],
+		if err != nil {
+			res.err = err
+			return res
 		}
-		if _, exists := supportedCountries[v[2]]; exists {
-			rec.Region = v[4]
-			rec.City = v[5]
+		if ok {
+			res.recs = append(res.recs, rec)
+			res.lines = append(res.lines, row.line)
 		}
-		*ipRecs = append(*ipRecs, rec)
 	}
-	close(done)
+	return res
+}
+
+//Scratch values for parsing range bounds, so rows that are rejected or
+//skipped cost no allocations
+var bigPool = sync.Pool{New: func() any { return new(big.Int) }}
+
+//ok is false for rows that should be skipped, such as unassigned ranges
+func parseRow(v []string) (rec ip2locRec, ok bool, err error) {
+	if n := recFields(); len(v) < n {
+		return rec, false, fmt.Errorf("Error with record: expected %d fields, got %d: %v\n", n, len(v), v)
+	}
+	fromNum, ipNum := bigPool.Get().(*big.Int), bigPool.Get().(*big.Int)
+	defer bigPool.Put(fromNum)
+	defer bigPool.Put(ipNum)
+	if _, ok := fromNum.SetString(v[cfg.colFrom], 10); !ok {
+		return rec, false, fmt.Errorf("Error with record: %v\n", v)
+	}
+	if _, ok := ipNum.SetString(v[cfg.colIP], 10); !ok {
+		return rec, false, fmt.Errorf("Error with record: %v\n", v)
+	}
+	//Lookups binary search on the bounds, so one out of order or out of range
+	//would throw off every search passing it
+	if fromNum.Sign() < 0 || ipNum.Sign() < 0 || ipNum.BitLen() > 128 {
+		return rec, false, fmt.Errorf("Error with record: range outside the IPv6 address space: %v\n", v)
+	}
+	if fromNum.Cmp(ipNum) > 0 {
+		return rec, false, fmt.Errorf("Error with record: fromIP above toIP: %v\n", v)
+	}
+	country := v[cfg.colCountry]
+	if country == "-" || !keepCountry(country) {
+		return rec, false, nil
+	}
+	rec = ip2locRec{
+		CountryCode: country,
+		//Left empty for codes missing from the table
+		CountryName: isoCountries[strings.ToUpper(country)],
+	}
+	//Set copies the digits; assigning *fromNum would share the pooled
+	//value's backing array with the record
+	rec.FromIP.Set(fromNum)
+	rec.ToIP.Set(ipNum)
+	if cfg.allRegions || isSupported(country) {
+		rec.Region = v[cfg.colRegion]
+		rec.City = v[cfg.colCity]
+	}
+	if rec.Latitude, err = coord(v, cfg.colLat); err != nil {
+		return rec, false, fmt.Errorf("Error with record latitude: %v: %v\n", err, v)
+	}
+	if rec.Longitude, err = coord(v, cfg.colLon); err != nil {
+		return rec, false, fmt.Errorf("Error with record longitude: %v: %v\n", err, v)
+	}
+	return rec, true, nil
+}
+
+//Applies -allow or -deny
+func keepCountry(code string) bool {
+	code = strings.ToUpper(code)
+	if cfg.allow != nil {
+		_, ok := cfg.allow[code]
+		return ok
+	}
+	_, denied := cfg.deny[code]
+	return !denied
+}
+
+func isSupported(code string) bool {
+	supportedMu.RLock()
+	defer supportedMu.RUnlock()
+	_, exists := supportedCountries[code]
+	return exists
+}
+
+//Missing columns and "-" placeholders leave the coordinate at zero
+func coord(v []string, col int) (float64, error) {
+	if col < 0 || col >= len(v) || v[col] == "-" || v[col] == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(v[col], 64)
 }
@@ -0,0 +1,868 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRowShort(t *testing.T) {
+	keepConfig(t)
+	row := []string{"16777216", "16777471"}
+	_, ok, err := parseRow(row)
+	if err == nil || ok {
+		t.Fatalf("parseRow(%q) = %v, %v; want an error", row, ok, err)
+	}
+	if !strings.Contains(err.Error(), "expected 6 fields, got 2") {
+		t.Errorf("Error %q does not give the field counts", err)
+	}
+
+	//The batch stops at the short row, or passes over it with -lenient
+	b := rowBatch{rows: []csvRow{{row, 1}, {[]string{"16777472", "16778239", "CN", "China", "Fujian", "Fuzhou"}, 2}}}
+	if res := parseRows(b); res.err == nil {
+		t.Error("parseRows accepted a two-field row")
+	}
+	cfg.lenient = true
+	res := parseRows(b)
+	if res.err != nil || len(res.recs) != 1 || len(res.skipped) != 1 {
+		t.Errorf("parseRows with -lenient gave %d records, %v skipped, error %v; want 1, 1 and none", len(res.recs), res.skipped, res.err)
+	}
+}
+
+//Bounds past 2^128-1 or the wrong way round are bad rows, which -lenient
+//passes over
+func TestParseRowRange(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+	}{
+		{"to at 2^128", "0", "340282366920938463463374607431768211456"},
+		{"from above to", "16777471", "16777216"},
+		{"negative from", "-1", "16777216"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepConfig(t)
+			row := []string{tt.from, tt.to, "AU", "Australia", "Queensland", "Brisbane"}
+			if _, ok, err := parseRow(row); err == nil || ok {
+				t.Fatalf("parseRow(%q) = %v, %v; want an error", row, ok, err)
+			}
+			b := rowBatch{rows: []csvRow{{row, 1}, {[]string{"16777472", "16778239", "CN", "China", "Fujian", "Fuzhou"}, 2}}}
+			cfg.lenient = true
+			res := parseRows(b)
+			if res.err != nil || len(res.recs) != 1 || len(res.skipped) != 1 {
+				t.Errorf("parseRows with -lenient gave %d records, %v skipped, error %v; want 1, 1 and none", len(res.recs), res.skipped, res.err)
+			}
+		})
+	}
+
+	//The last address of the IPv6 space is a valid bound
+	row := []string{"0", "340282366920938463463374607431768211455", "US", "United States of America", "California", "Los Angeles"}
+	if _, ok, err := parseRow(row); err != nil || !ok {
+		t.Errorf("parseRow(%q) = %v, %v; want a record", row, ok, err)
+	}
+}
+
+func TestLoadErrorStatus(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", 500)
+	}))
+	t.Cleanup(failing.Close)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	tests := []struct {
+		name  string
+		setup func(t testing.TB)
+		ip    string
+		want  int
+		//Status of / afterwards
+		dump int
+	}{
+		{"upstream error", func(t testing.TB) { useUpstream(t, failing.URL) }, "1.0.0.5", 502, 502},
+		{"upstream unreachable", func(t testing.TB) { useUpstream(t, gone.URL) }, "1.0.0.5", 502, 502},
+		{"not a zip", func(t testing.TB) {
+			useUpstream(t, testUpstream(t, []byte("not a zip")).URL)
+			cfg.archive = "zip"
+		}, "1.0.0.5", 502, 502},
+		{"bad row", func(t testing.TB) {
+			useUpstream(t, testUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV+"\"oops\",\"1\",\"US\",\"-\",\"-\",\"-\"\n")).URL)
+		}, "1.0.0.5", 500, 500},
+		{"missing file", func(t testing.TB) {
+			useUpstream(t, "")
+			cfg.file = filepath.Join(t.TempDir(), "missing.zip")
+		}, "1.0.0.5", 500, 500},
+		{"no matching range", useTestData, "9.9.9.9", 404, 200},
+		{"match", useTestData, "1.0.0.5", 200, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+			rr := get(appHandler(ip2locLookup), "/lookup?ip="+tt.ip)
+			if rr.Code != tt.want {
+				t.Errorf("Status %d, want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+
+			//A failed load leaves the cache cold, and / reports why rather
+			//than that the data is still loading
+			rr = get(appHandler(ip2locInit), "/")
+			if rr.Code != tt.dump {
+				t.Errorf("/ status %d, want %d: %s", rr.Code, tt.dump, rr.Body)
+			}
+			if got := rr.Header().Get("Retry-After"); got != "" {
+				t.Errorf("/ has Retry-After %q with no load running", got)
+			}
+			//The retry / started must not outlive the test's settings
+			cache.flightMu.Lock()
+			call := cache.flight
+			cache.flightMu.Unlock()
+			if call != nil {
+				<-call.done
+			}
+		})
+	}
+}
+
+//A request still waiting on a load when -request-timeout passes is a 504,
+//and the load it alone was waiting on is abandoned
+func TestRequestTimeout(t *testing.T) {
+	up := newGatedUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+	cfg.requestTimeout = 200 * time.Millisecond
+
+	answered := make(chan *httptest.ResponseRecorder)
+	go func() { answered <- get(appHandler(ip2locLookup), "/lookup?ip=1.0.0.5") }()
+	waitForWaiters(t, 1)
+	cache.flightMu.Lock()
+	call := cache.flight
+	cache.flightMu.Unlock()
+
+	rr := <-answered
+	if rr.Code != 504 {
+		t.Fatalf("Status %d, want 504: %s", rr.Code, rr.Body)
+	}
+	select {
+	case <-call.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Load still running after its only request timed out")
+	}
+	if up.hits.Load() != 1 {
+		t.Errorf("Upstream fetched %d times, want 1", up.hits.Load())
+	}
+}
+
+//Coordinates don't depend on -countries, unlike region and city
+func TestParseRowCoordinates(t *testing.T) {
+	keepConfig(t)
+	for _, row := range [][]string{
+		{"16777216", "16777471", "AU", "Australia", "Queensland", "Brisbane", "-27.46794", "153.02809"},
+		{"16777472", "16778239", "CN", "China", "Fujian", "Fuzhou", "26.06139", "119.30611"},
+	} {
+		rec, ok, err := parseRow(row)
+		if err != nil || !ok {
+			t.Fatalf("parseRow(%q) = %v, %v", row, ok, err)
+		}
+		if rec.Latitude == 0 || rec.Longitude == 0 {
+			t.Errorf("%s record has coordinates %v,%v; want %s,%s", row[2], rec.Latitude, rec.Longitude, row[6], row[7])
+		}
+	}
+	if _, _, err := parseRow([]string{"1", "2", "CN", "China", "-", "-", "north", "0"}); err == nil {
+		t.Error("Accepted a latitude that is not a number")
+	}
+}
+
+//A read error late in a -lenient load ends it while parser may still be
+//recording skipped rows. Run with -race.
+func TestLenientLoadFailsLate(t *testing.T) {
+	keepConfig(t)
+	awaitGoroutines(t)
+	cfg.lenient = true
+	cfg.archive = "csv"
+	var b strings.Builder
+	for i := 0; i < 20*parseBatch; i++ {
+		fmt.Fprintf(&b, "\"x%d\",\"1\",\"US\",\"-\",\"-\",\"-\"\n", i)
+	}
+	//A bare quote, which the CSV reader rejects
+	b.WriteString("\"1\",\"2\"x,\"US\"\n")
+	cfg.file = writeTemp(t, "bad.csv", []byte(b.String()))
+
+	res, e := load(context.Background(), validators{}, func(*ip2locRec) {})
+	if e == nil {
+		t.Fatal("Load with a malformed row succeeded")
+	}
+	if res.skipped.count != 0 {
+		t.Errorf("Failed load reported %d skipped rows", res.skipped.count)
+	}
+}
+
+//n rows in CSV order, each range one address wide
+func testRows(n int) [][]string {
+	rows := make([][]string, n)
+	for i := range rows {
+		ip := strconv.Itoa(16777216 + i)
+		rows[i] = []string{ip, ip, "US", "United States of America", "California", "Los Angeles"}
+	}
+	return rows
+}
+
+//Feeds rows through parser and collects what it emits
+func runParser(ctx context.Context, rows [][]string) ([]ip2locRec, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	in := make(chan csvRow, cfg.buffer)
+	out := make(chan ip2locRec, 1024)
+	abort := make(chan error, 2)
+	go func() {
+		defer close(in)
+		for i, row := range rows {
+			select {
+			case in <- csvRow{row, i + 1}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go parser(ctx, stop, in, out, abort, new(skipReport), nil)
+	var recs []ip2locRec
+	for rec := range out {
+		recs = append(recs, rec)
+	}
+	select {
+	case err := <-abort:
+		return recs, err
+	default:
+		return recs, nil
+	}
+}
+
+//Batches are parsed out of order by the workers but emitted in CSV order
+func TestParserPreservesOrder(t *testing.T) {
+	keepConfig(t)
+	cfg.workers = 8
+	rows := testRows(7*parseBatch + 17)
+	recs, err := runParser(context.Background(), rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != len(rows) {
+		t.Fatalf("Parsed %d records from %d rows", len(recs), len(rows))
+	}
+	for i, rec := range recs {
+		if rec.ToIP.String() != rows[i][1] {
+			t.Fatalf("Record %d has toIP %s, want %s", i, rec.ToIP.String(), rows[i][1])
+		}
+	}
+}
+
+//Run with -cpu 1,2,4,8 to see how the workers scale with GOMAXPROCS
+func BenchmarkParser(b *testing.B) {
+	keepConfig(b)
+	rows := testRows(64 * parseBatch)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg.workers = workers
+			for i := 0; i < b.N; i++ {
+				if _, err := runParser(context.Background(), rows); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(rows)*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+//Cancelling ctx stops the parser even while its input is still open
+func TestParserStopsOnCancel(t *testing.T) {
+	keepConfig(t)
+	cfg.workers = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan csvRow)
+	out := make(chan ip2locRec)
+	abort := make(chan error, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		parser(ctx, cancel, in, out, abort, new(skipReport), nil)
+	}()
+	for i, row := range testRows(parseBatch + 1) {
+		in <- csvRow{row, i + 1}
+	}
+	<-out
+	cancel()
+	//out may still hold records sent before the cancel
+	go func() {
+		for range out {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Parser still running a second after its context was cancelled")
+	}
+}
+
+//Records loaded from data as -file
+func loadFile(t testing.TB, name string, data []byte) ([]ip2locRec, *appError) {
+	t.Helper()
+	cfg.file = writeTemp(t, name, data)
+	return loadAll()
+}
+
+//Records loaded from -file or -upstream
+func loadAll() ([]ip2locRec, *appError) {
+	var recs []ip2locRec
+	_, e := load(context.Background(), validators{}, func(rec *ip2locRec) { recs = append(recs, *rec) })
+	return recs, e
+}
+
+//A renamed CSV is found through -csv-name, or as the zip's only *.CSV
+func TestCSVMemberName(t *testing.T) {
+	tests := []struct {
+		name    string
+		csvName string
+		members []string
+	}{
+		{"expected name", "IPV6-COUNTRY-REGION-CITY.CSV", []string{"README.TXT", "x", "IPV6-COUNTRY-REGION-CITY.CSV", testCSV}},
+		{"renamed", "IPV6-COUNTRY-REGION-CITY.CSV", []string{"README.TXT", "x", "IP2LOCATION-LITE-DB3.IPV6.CSV", testCSV}},
+		{"lower case extension", "IPV6-COUNTRY-REGION-CITY.CSV", []string{"db3.csv", testCSV}},
+		{"-csv-name", "DB3.CSV", []string{"OTHER.CSV", "\"1\",\"oops\"\n", "DB3.CSV", testCSV}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepConfig(t)
+			cfg.csvName = tt.csvName
+			recs, e := loadFile(t, "data.zip", testZip(t, tt.members...))
+			if e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			//testCSV's unassigned range is dropped
+			if len(recs) != 3 {
+				t.Errorf("Loaded %d records, want 3", len(recs))
+			}
+		})
+	}
+}
+
+//An empty zip says so, whether upstream sent it or -file names it
+func TestEmptyZip(t *testing.T) {
+	empty := testZip(t)
+	tests := []struct {
+		name  string
+		setup func(t testing.TB)
+		want  int
+	}{
+		{"upstream", func(t testing.TB) { useUpstream(t, testUpstream(t, empty).URL) }, 502},
+		{"file", func(t testing.TB) {
+			useUpstream(t, "")
+			cfg.file = writeTemp(t, "empty.zip", empty)
+		}, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+			rr := get(appHandler(ip2locLookup), "/lookup?ip=1.0.0.5")
+			if rr.Code != tt.want {
+				t.Errorf("Status %d, want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if !strings.Contains(rr.Body.String(), "empty zip") {
+				t.Errorf("Body %q does not say the zip is empty", rr.Body)
+			}
+		})
+	}
+}
+
+//A zip without the CSV is bad data from upstream, not an empty dataset
+func TestZipWithoutCSV(t *testing.T) {
+	useUpstream(t, testUpstream(t, testZip(t, "README.TXT", "No data this month")).URL)
+	rr := get(appHandler(ip2locLookup), "/lookup?ip=1.0.0.5")
+	if rr.Code != 502 {
+		t.Fatalf("Status %d, want 502: %s", rr.Code, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), "Invalid IP2Location data") {
+		t.Errorf("Body %q does not say the data is invalid", rr.Body)
+	}
+}
+
+func openFiles(t testing.TB) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("Open files cannot be counted here:", err)
+	}
+	return len(fds)
+}
+
+//Each load closes the data file and the member it read by the time it
+//returns, whether it succeeded or failed
+func TestLoadReleasesFiles(t *testing.T) {
+	keepConfig(t)
+	members := []string{"README.TXT", "x", "A.CSV", testCSV, "B.CSV", testCSV}
+	good := testZip(t, members...)
+	bad := testZip(t, append(members, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV+"\"oops\",\"1\"\n")...)
+	before := openFiles(t)
+	for i := 0; i < 20; i++ {
+		if _, e := loadFile(t, "good.zip", good); e != nil {
+			t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+		}
+		if _, e := loadFile(t, "bad.zip", bad); e == nil {
+			t.Fatal("Load of a malformed CSV succeeded")
+		}
+	}
+	//Connections left by earlier tests may close meanwhile, so only a rise counts
+	if after := openFiles(t); after > before {
+		t.Errorf("%d files open after 40 loads, %d before", after, before)
+	}
+}
+
+//A dump requested before the first load has finished is a 503 with
+//Retry-After, not a wait or an empty dataset
+func TestDumpWhileLoading(t *testing.T) {
+	up := newGatedUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+	h := appHandler(ip2locInit)
+
+	rr := get(h, "/")
+	if rr.Code != 503 {
+		t.Fatalf("Status %d on a cold cache, want 503: %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Retry-After"); got != strconv.Itoa(loadingRetryAfter) {
+		t.Errorf("Retry-After %q, want %d", got, loadingRetryAfter)
+	}
+	//The 503 started the load, which has reached upstream
+	for up.hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if rr := get(h, "/"); rr.Code != 503 {
+		t.Errorf("Status %d while the load is running, want 503", rr.Code)
+	}
+
+	close(up.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr = get(h, "/")
+		if rr.Code != 503 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rr.Code != 200 || rr.Header().Get("Recs-Total") != "3" {
+		t.Errorf("Status %d with %s records once loaded, want 200 with 3", rr.Code, rr.Header().Get("Recs-Total"))
+	}
+	if n := up.hits.Load(); n != 1 {
+		t.Errorf("Upstream fetched %d times, want 1", n)
+	}
+}
+
+//A .csv.gz as IP2Location ships it, found by its magic bytes or -archive
+func TestLoadGzipFixture(t *testing.T) {
+	for _, archive := range []string{"auto", "gzip"} {
+		t.Run(archive, func(t *testing.T) {
+			keepConfig(t)
+			cfg.file = filepath.Join("testdata", "IPV6-COUNTRY-REGION-CITY.CSV.gz")
+			cfg.archive = archive
+			recs, e := loadAll()
+			if e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			if len(recs) != 3 || recs[2].CountryCode != "US" || recs[2].City != "Los Angeles" {
+				t.Errorf("Loaded %+v, want testCSV's three countries", recs)
+			}
+		})
+	}
+	keepConfig(t)
+	cfg.file = filepath.Join("testdata", "IPV6-COUNTRY-REGION-CITY.CSV.gz")
+	cfg.archive = "zip"
+	if _, e := loadAll(); e == nil {
+		t.Error("Loaded a .csv.gz as a zip")
+	}
+}
+
+//A zip64 archive from zip -fz, which carries zip64 extra fields and end
+//records even though nothing in it is over 4GB
+func TestLoadZip64Fixture(t *testing.T) {
+	keepConfig(t)
+	cfg.file = filepath.Join("testdata", "zip64.zip")
+	data, err := os.ReadFile(cfg.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("PK\x06\x06")) {
+		t.Fatal("Fixture has no zip64 end of central directory record")
+	}
+	recs, e := loadAll()
+	if e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	if len(recs) != 3 || recs[2].CountryCode != "US" || recs[2].City != "Los Angeles" {
+		t.Errorf("Loaded %+v, want testCSV's three countries", recs)
+	}
+}
+
+//The reader to parser handoff at a few -buffer sizes; run with -benchmem to
+//see what the larger ones hold
+func BenchmarkLoadBuffer(b *testing.B) {
+	keepConfig(b)
+	var csv strings.Builder
+	for _, row := range testRows(64 * parseBatch) {
+		fmt.Fprintf(&csv, "%q,%q,%q,%q,%q,%q\n", row[0], row[1], row[2], row[3], row[4], row[5])
+	}
+	cfg.file = writeTemp(b, "bench.csv", []byte(csv.String()))
+	cfg.archive = "csv"
+	for _, buffer := range []int{0, 64, 1024, 16384} {
+		b.Run(fmt.Sprintf("buffer=%d", buffer), func(b *testing.B) {
+			cfg.buffer = buffer
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, e := load(context.Background(), validators{}, func(*ip2locRec) {}); e != nil {
+					b.Fatal(e.Error)
+				}
+			}
+			b.ReportMetric(float64(64*parseBatch*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+//A bad row fails the parser while a malformed line fails the reader at about
+//the same time; neither may be left blocked reporting its error
+func TestLoadBothProducersFail(t *testing.T) {
+	keepConfig(t)
+	cfg.archive = "csv"
+	var b strings.Builder
+	b.WriteString("\"16777216\",\"16777471\",\"AU\",\"Australia\",\"Queensland\",\"Brisbane\"\n")
+	b.WriteString("\"oops\",\"1\",\"US\",\"-\",\"-\",\"-\"\n")
+	for i := 0; i < 2*parseBatch; i++ {
+		fmt.Fprintf(&b, "\"%d\",\"%d\",\"US\",\"-\",\"-\",\"-\"\n", 16777472+i, 16777472+i)
+	}
+	b.WriteString("\"1\",\"2\"x,\"US\"\n")
+	cfg.file = writeTemp(t, "bad.csv", []byte(b.String()))
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		if _, e := loadAll(); e == nil {
+			t.Fatal("Load with a bad row and a malformed line succeeded")
+		}
+	}
+	//load waits for reader and parser, so they are gone once it returns
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after 50 failed loads, %d before", after, before)
+	}
+}
+
+//A panic while parsing fails the request with a 500 instead of the process.
+//A negative column slips past parseFlags' checks when set directly, indexing
+//out of range for every supported country's row.
+func TestParsePanicIs500(t *testing.T) {
+	useTestData(t)
+	cfg.colRegion = -1
+	rr := get(appHandler(ip2locLookup), "/lookup?ip=1.0.0.5")
+	if rr.Code != 500 {
+		t.Fatalf("Status %d, want 500: %s", rr.Code, rr.Body)
+	}
+	if !strings.Contains(rr.Body.String(), "Error preparing IP2Location data") {
+		t.Errorf("Body %q does not report a failed load", rr.Body)
+	}
+}
+
+//A header row is skipped when -skip-header asks for it or, under auto, when
+//it is not data; errors still name the line of the file they come from
+func TestSkipHeader(t *testing.T) {
+	const (
+		header = "\"ip_from\",\"ip_to\",\"country_code\",\"country_name\",\"region_name\",\"city_name\"\n"
+		au     = "\"16777216\",\"16777471\",\"AU\",\"Australia\",\"Queensland\",\"Brisbane\"\n"
+		//A quoted line break makes the row span two lines
+		cn  = "\"16777472\",\"16778239\",\"CN\",\"China\",\"Fujian\",\"Fu\nzhou\"\n"
+		bad = "\"oops\",\"1\",\"US\",\"-\",\"-\",\"-\"\n"
+	)
+	tests := []struct {
+		name       string
+		skipHeader string
+		csv        string
+		records    int
+		skipped    []string
+	}{
+		{"header present", "auto", header + au + bad, 1, []string{"Line 3:"}},
+		{"header absent", "auto", au + bad, 1, []string{"Line 2:"}},
+		{"multi-line row", "auto", header + cn + au + bad, 2, []string{"Line 5:"}},
+		{"forced", "true", au + bad, 0, []string{"Line 2:"}},
+		{"disabled", "false", header + au + bad, 1, []string{"Line 1:", "Line 3:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepConfig(t)
+			cfg.skipHeader = tt.skipHeader
+			cfg.archive = "csv"
+			cfg.lenient = true
+			cfg.file = writeTemp(t, "data.csv", []byte(tt.csv))
+			var recs []ip2locRec
+			res, e := load(context.Background(), validators{}, func(rec *ip2locRec) { recs = append(recs, *rec) })
+			if e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			if len(recs) != tt.records {
+				t.Errorf("Loaded %d records, want %d", len(recs), tt.records)
+			}
+			if len(res.skipped.sample) != len(tt.skipped) {
+				t.Fatalf("Skipped %q, want %d rows", res.skipped.sample, len(tt.skipped))
+			}
+			for i, prefix := range tt.skipped {
+				if !strings.HasPrefix(res.skipped.sample[i], prefix) {
+					t.Errorf("Skipped row %q, want it to start %q", res.skipped.sample[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+//-delimiter splits on the given rune only, so commas stay inside fields
+func TestLoadSemicolonFixture(t *testing.T) {
+	keepConfig(t)
+	if err := setDelimiter(";"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.file = filepath.Join("testdata", "semicolon.csv")
+	recs, e := loadAll()
+	if e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	if len(recs) != 3 || recs[2].City != "Los Angeles, CA" {
+		t.Errorf("Loaded %+v, want three records ending in Los Angeles, CA", recs)
+	}
+
+	for _, d := range []string{"", ";;", "\n", "\""} {
+		if err := setDelimiter(d); err == nil {
+			t.Errorf("Accepted delimiter %q", d)
+		}
+	}
+}
+
+//Records dropped by -allow or -deny are never cached
+func TestAllowDeny(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"no filter", nil, []string{"AU", "CN", "US"}},
+		{"allow", []string{"-allow", "us, au"}, []string{"AU", "US"}},
+		{"deny", []string{"-deny", "cn"}, []string{"AU", "US"}},
+		{"allow none present", []string{"-allow", "DE"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestData(t)
+			if err := parseFlags("serve", tt.args); err != nil {
+				t.Fatal(err)
+			}
+			recs, e := cache.get(context.Background())
+			if e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			var got []string
+			for _, rec := range recs {
+				got = append(got, rec.CountryCode)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Cached countries %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	keepConfig(t)
+	if err := parseFlags("serve", []string{"-allow", "US", "-deny", "CN"}); err == nil {
+		t.Error("Accepted -allow with -deny")
+	}
+}
+
+//Names come from the embedded ISO 3166 table; unknown codes keep their
+//record with an empty name
+func TestParseRowCountryName(t *testing.T) {
+	keepConfig(t)
+	tests := []struct {
+		code, want string
+	}{
+		{"AU", "Australia"},
+		{"de", "Germany"},
+		{"CI", "Côte d'Ivoire"},
+		{"XX", ""},
+		{"UK", ""},
+	}
+	for _, tt := range tests {
+		//The CSV's own name column is not used
+		rec, ok, err := parseRow([]string{"1", "2", tt.code, "From the CSV", "-", "-"})
+		if err != nil || !ok {
+			t.Fatalf("parseRow with country %s = %v, %v", tt.code, ok, err)
+		}
+		if rec.CountryName != tt.want {
+			t.Errorf("Country %s named %q, want %q", tt.code, rec.CountryName, tt.want)
+		}
+	}
+}
+
+//A ResponseWriter standing in for a client that stops reading at the first
+//chunk: the first Flush reports how much was written and blocks until resume
+//is closed
+type stallingWriter struct {
+	*httptest.ResponseRecorder
+	flushed chan int
+	resume  chan struct{}
+	once    sync.Once
+}
+
+func (w *stallingWriter) Flush() {
+	w.once.Do(func() {
+		w.flushed <- w.Body.Len()
+		<-w.resume
+	})
+	w.ResponseRecorder.Flush()
+}
+
+//A dump is flushed in batches, so a slow client has its first records well
+//before the handler has encoded the last
+func TestDumpStreamsToSlowReader(t *testing.T) {
+	keepConfig(t)
+	freshCache(t)
+	const records = 8 * parseBatch
+	var csv strings.Builder
+	for _, row := range testRows(records) {
+		fmt.Fprintf(&csv, "%q,%q,%q,%q,%q,%q\n", row[0], row[1], row[2], row[3], row[4], row[5])
+	}
+	cfg.file = writeTemp(t, "big.csv", []byte(csv.String()))
+	cfg.archive = "csv"
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+
+	w := &stallingWriter{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan int), resume: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		appHandler(ip2locInit).ServeHTTP(w, httptest.NewRequest("GET", "/?format=ndjson", nil))
+	}()
+	first := <-w.flushed
+	select {
+	case <-done:
+		t.Fatal("Handler finished while the client was stalled")
+	default:
+	}
+	close(w.resume)
+	<-done
+
+	total := w.Body.Len()
+	if first == 0 || first >= total {
+		t.Errorf("First chunk was %d of %d bytes, want part of the response", first, total)
+	}
+	if n := strings.Count(w.Body.String(), "\n"); n != records {
+		t.Errorf("Wrote %d records, want %d", n, records)
+	}
+}
+
+//Rows as in the IPv6 dataset, where most bounds need two words, every
+//fourth one an unassigned range that is dropped
+func benchRows() [][]string {
+	rows := make([][]string, parseBatch)
+	base, _ := new(big.Int).SetString("42540766411282592856903984951653826560", 10)
+	for i := range rows {
+		from := new(big.Int).Add(base, big.NewInt(int64(i)<<16))
+		to := new(big.Int).Add(from, big.NewInt(1<<16-1))
+		country, name := "US", "United States of America"
+		if i%4 == 0 {
+			country, name = "-", "-"
+		}
+		rows[i] = []string{from.String(), to.String(), country, name, "California", "Los Angeles"}
+	}
+	return rows
+}
+
+//Run with -benchmem: the pooled scratch values keep dropped rows free of
+//allocations
+func BenchmarkParseRow(b *testing.B) {
+	keepConfig(b)
+	rows := benchRows()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, row := range rows {
+			if _, _, err := parseRow(row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+//Gives the test its own -max-parses slots, sized from cfg on first use
+func freshParseSlots(t testing.TB) {
+	t.Helper()
+	parseSemOnce, parseSem = sync.Once{}, nil
+	t.Cleanup(func() { parseSemOnce, parseSem = sync.Once{}, nil })
+}
+
+//Loads beyond -max-parses wait for a slot, or give up with a 503 when their
+//caller leaves first
+func TestMaxParses(t *testing.T) {
+	keepConfig(t)
+	freshParseSlots(t)
+	cfg.maxParses = 2
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	release := make(chan struct{})
+	open := func(ctx context.Context, cond validators) (*dataFile, error) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, fmt.Errorf("Released")
+	}
+	runningNow := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return running
+	}
+
+	const loads = 5
+	var wg sync.WaitGroup
+	for range loads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loadFrom(t.Context(), open, nil, validators{}, func(*ip2locRec) {})
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runningNow() < cfg.maxParses {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d loads running, want %d", runningNow(), cfg.maxParses)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//Every slot is taken, so a caller that leaves gets its answer at once
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if _, e := loadFrom(ctx, open, nil, validators{}, func(*ip2locRec) {}); e == nil || e.Code != 503 {
+		t.Errorf("Load while all slots were taken = %v, want a 503", e)
+	}
+	close(release)
+	wg.Wait()
+	if most != cfg.maxParses {
+		t.Errorf("%d loads ran at once, want %d", most, cfg.maxParses)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Minimum gap between progress events published while parsing
+const progressInterval = 250 * time.Millisecond
+
+type progressEvent struct {
+	Records int    `json:"records"`
+	Error   string `json:"error,omitempty"`
+}
+
+//Fans out load progress to /progress subscribers. Sends never block: a slow
+//subscriber misses intermediate counts but always sees the load end, as its
+//channel is closed then.
+type progressBroker struct {
+	mu     sync.Mutex
+	active bool
+	last   progressEvent
+	subs   map[chan progressEvent]struct{}
+}
+
+//Where the cache's loads report. Dry runs pass a nil broker instead, whose
+//methods do nothing, so /progress only ever follows the data being served.
+var progress = &progressBroker{subs: make(map[chan progressEvent]struct{})}
+
+func (b *progressBroker) start() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.active, b.last = true, progressEvent{}
+	b.mu.Unlock()
+}
+
+func (b *progressBroker) publish(records int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last.Records = records
+	for ch := range b.subs {
+		select {
+		case ch <- b.last:
+		default:
+		}
+	}
+}
+
+//Ends the load, closing every subscription
+func (b *progressBroker) finish(records int, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active = false
+	b.last = progressEvent{Records: records}
+	if err != nil {
+		b.last.Error = err.Error()
+	}
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+	}
+}
+
+//Events for the load in flight, or false if there is none
+func (b *progressBroker) subscribe() (chan progressEvent, progressEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.active {
+		return nil, b.last, false
+	}
+	ch := make(chan progressEvent, 16)
+	b.subs[ch] = struct{}{}
+	return ch, b.last, true
+}
+
+func (b *progressBroker) unsubscribe(ch chan progressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+//Outcome of the most recent load, once its subscriptions have closed
+func (b *progressBroker) result() progressEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+//Server-Sent Events with the records parsed so far. The stream ends with a
+//done or error event when the load finishes, or straight away if none is running.
+func ip2locProgress(w http.ResponseWriter, r *http.Request) *appError {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &appError{fmt.Errorf("%T cannot flush", w), "Streaming unsupported", 500}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	send := func(event string, ev progressEvent) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	end := func(ev progressEvent) *appError {
+		event := "done"
+		if ev.Error != "" {
+			event = "error"
+		}
+		send(event, ev)
+		return nil
+	}
+
+	ch, cur, active := progress.subscribe()
+	if !active {
+		return end(cur)
+	}
+	defer progress.unsubscribe(ch)
+	if err := send("progress", cur); err != nil {
+		return nil
+	}
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return end(progress.result())
+			}
+			if err := send("progress", ev); err != nil {
+				return nil
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+//Protobuf wire types used by ip2loc.proto
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+//Streams Record messages from ip2loc.proto, each preceded by its varint
+//length like Java's writeDelimitedTo. Hand-written, as the message is flat,
+//so the server needs no protoc-generated code; the protobuf module is only
+//pulled in by grpc and used by the tests to check these bytes.
+type protobufEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *protobufEncoder) Encode(rec *ip2locRec) error {
+	msg := appendProtoRecord(e.buf[:0], rec)
+	e.buf = msg
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(msg)))
+	if _, err := e.w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(msg)
+	return err
+}
+
+func (e *protobufEncoder) Close() error {
+	return nil
+}
+
+//rec as a Record message, appended to b
+func appendProtoRecord(b []byte, rec *ip2locRec) []byte {
+	b = appendProtoString(b, 1, rec.FromIP.String())
+	b = appendProtoString(b, 2, rec.ToIP.String())
+	b = appendProtoString(b, 3, rec.CountryCode)
+	b = appendProtoString(b, 4, rec.CountryName)
+	b = appendProtoString(b, 5, rec.Region)
+	b = appendProtoString(b, 6, rec.City)
+	b = appendProtoDouble(b, 7, rec.Latitude)
+	return appendProtoDouble(b, 8, rec.Longitude)
+}
+
+//Fields holding their proto3 default are left out, as protoc's code does
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//Rows with coordinates and IPv6-sized bounds, so every Record field is set
+const coordCSV = `"16777216","16777471","AU","Australia","Queensland","Brisbane","-27.46794","153.02809"
+"16777472","16778239","CN","China","Fujian","Fuzhou","26.06139","119.30611"
+"42540766411282592856903984951653826560","42540766411282592875350729025363378175","US","United States of America","California","Los Angeles","34.05223","-118.24368"
+`
+
+//Loads coordCSV into the cache
+func warmCoordData(t testing.TB) {
+	t.Helper()
+	useUpstream(t, testUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", coordCSV)).URL)
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Loading test data: %v: %s", e.Error, e.Message)
+	}
+}
+
+var (
+	protoComment = regexp.MustCompile(`//.*`)
+	protoPackage = regexp.MustCompile(`package (\w+);`)
+	protoMessage = regexp.MustCompile(`message (\w+) \{([^}]*)\}`)
+	protoField   = regexp.MustCompile(`(map<(\w+), (\w+)>|\w+) (\w+) = (\d+);`)
+	protoRPC     = regexp.MustCompile(`rpc (\w+)\((stream )?(\w+)\) returns \((stream )?(\w+)\);`)
+)
+
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+}
+
+//ip2loc.proto as a descriptor, so the hand-written messages are checked
+//against the schema clients generate code from rather than a copy of it. The
+//parser only knows what the file uses: flat messages of scalars and maps, and
+//one service.
+func protoSchema(t testing.TB) protoreflect.FileDescriptor {
+	t.Helper()
+	src, err := os.ReadFile("ip2loc.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := protoComment.ReplaceAllString(string(src), "")
+	pkg := protoPackage.FindStringSubmatch(text)
+	if pkg == nil {
+		t.Fatal("ip2loc.proto has no package")
+	}
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("ip2loc.proto"),
+		Package: proto.String(pkg[1]),
+		Syntax:  proto.String("proto3"),
+	}
+	scalar := func(name string) descriptorpb.FieldDescriptorProto_Type {
+		typ, ok := protoScalars[name]
+		if !ok {
+			t.Fatalf("ip2loc.proto uses type %s, which protoSchema cannot read", name)
+		}
+		return typ
+	}
+
+	for _, m := range protoMessage.FindAllStringSubmatch(text, -1) {
+		msg := &descriptorpb.DescriptorProto{Name: proto.String(m[1])}
+		for _, f := range protoField.FindAllStringSubmatch(m[2], -1) {
+			num, _ := strconv.Atoi(f[5])
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(f[4]),
+				Number:   proto.Int32(int32(num)),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				JsonName: proto.String(protoJSONName(f[4])),
+			}
+			if f[2] == "" {
+				field.Type = scalar(f[1]).Enum()
+			} else {
+				//A map is a repeated entry message named after the field
+				entry := protoCamel(f[4]) + "Entry"
+				msg.NestedType = append(msg.NestedType, &descriptorpb.DescriptorProto{
+					Name: proto.String(entry),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("key"), JsonName: proto.String("key"), Number: proto.Int32(1), Label: field.Label, Type: scalar(f[2]).Enum()},
+						{Name: proto.String("value"), JsonName: proto.String("value"), Number: proto.Int32(2), Label: field.Label, Type: scalar(f[3]).Enum()},
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				})
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String("." + pkg[1] + "." + m[1] + "." + entry)
+			}
+			msg.Field = append(msg.Field, field)
+		}
+		file.MessageType = append(file.MessageType, msg)
+	}
+
+	svc := &descriptorpb.ServiceDescriptorProto{Name: proto.String("IP2Location")}
+	for _, r := range protoRPC.FindAllStringSubmatch(text, -1) {
+		svc.Method = append(svc.Method, &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(r[1]),
+			InputType:       proto.String("." + pkg[1] + "." + r[3]),
+			OutputType:      proto.String("." + pkg[1] + "." + r[5]),
+			ClientStreaming: proto.Bool(r[2] != ""),
+			ServerStreaming: proto.Bool(r[4] != ""),
+		})
+	}
+	file.Service = []*descriptorpb.ServiceDescriptorProto{svc}
+
+	fd, err := protodesc.NewFile(file, new(protoregistry.Files))
+	if err != nil {
+		t.Fatalf("Building a descriptor from ip2loc.proto: %v", err)
+	}
+	return fd
+}
+
+//from_ip as FromIp, the way protoc names map entries
+func protoCamel(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func protoJSONName(name string) string {
+	camel := protoCamel(name)
+	return strings.ToLower(camel[:1]) + camel[1:]
+}
+
+//A Record message of schema holding rec, as protoc's code would fill it in
+func schemaRecord(schema protoreflect.FileDescriptor, rec *ip2locRec) *dynamicpb.Message {
+	msg := dynamicpb.NewMessage(schema.Messages().ByName("Record"))
+	fields := msg.Descriptor().Fields()
+	for name, v := range map[protoreflect.Name]protoreflect.Value{
+		"from_ip":      protoreflect.ValueOfString(rec.FromIP.String()),
+		"to_ip":        protoreflect.ValueOfString(rec.ToIP.String()),
+		"country_code": protoreflect.ValueOfString(rec.CountryCode),
+		"country_name": protoreflect.ValueOfString(rec.CountryName),
+		"region":       protoreflect.ValueOfString(rec.Region),
+		"city":         protoreflect.ValueOfString(rec.City),
+		"latitude":     protoreflect.ValueOfFloat64(rec.Latitude),
+		"longitude":    protoreflect.ValueOfFloat64(rec.Longitude),
+	} {
+		msg.Set(fields.ByName(name), v)
+	}
+	return msg
+}
+
+//?format=protobuf decodes, message by message, into the Records of
+//ip2loc.proto that hold the cached records, with no field left unknown
+func TestProtobufMatchesSchema(t *testing.T) {
+	warmCoordData(t)
+	schema := protoSchema(t)
+	view, _ := cache.snapshot()
+
+	rr := get(appHandler(ip2locInit), "/?format=protobuf")
+	if rr.Code != 200 {
+		t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+	}
+	body := rr.Body.Bytes()
+	for i := range view.recs {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || size > uint64(len(body)-n) {
+			t.Fatalf("Record %d: bad length prefix, %d bytes left", i, len(body))
+		}
+		got := dynamicpb.NewMessage(schema.Messages().ByName("Record"))
+		if err := proto.Unmarshal(body[n:n+int(size)], got); err != nil {
+			t.Fatalf("Record %d: %v", i, err)
+		}
+		body = body[n+int(size):]
+		if unknown := got.GetUnknown(); len(unknown) > 0 {
+			num, typ, _ := protowire.ConsumeTag(unknown)
+			t.Errorf("Record %d: field %d with wire type %d does not match ip2loc.proto", i, num, typ)
+		}
+		if want := schemaRecord(schema, &view.recs[i]); !proto.Equal(got, want) {
+			t.Errorf("Record %d decoded as %v, want %v", i, got, want)
+		}
+	}
+	if len(body) > 0 {
+		t.Errorf("%d bytes after the last record", len(body))
+	}
+}
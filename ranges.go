@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+//Every record for ?country=, streamed in range order in the same formats as /
+func ip2locRanges(w http.ResponseWriter, r *http.Request) *appError {
+	c := r.URL.Query().Get("country")
+	if c == "" {
+		return &appError{errors.New("Missing country parameter"), "Missing country query parameter", 400}
+	}
+	code, e := parseCountry(c)
+	if e != nil {
+		return e
+	}
+	format, e := outputFormat(r)
+	if e != nil {
+		return e
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+	recs, idx := view.recs, view.byCountry[code]
+
+	w.Header().Set("Content-Type", contentTypes[format])
+	bw := newDumpWriter(w)
+	defer bw.Flush()
+	enc := newRecEncoder(format, bw)
+	for n, i := range idx {
+		if err := enc.Encode(&recs[i]); err != nil {
+			return &appError{err, "Error marshalling IP2Location data", 500}
+		}
+		if (n+1)%parseBatch == 0 {
+			if err := bw.Flush(); err != nil {
+				return &appError{err, "Error writing IP2Location data", 500}
+			}
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
+	return nil
+}
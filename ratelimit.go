@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+//Clients idle this long lose their bucket; a returning client starts full
+const limiterIdle = 5 * time.Minute
+
+//Hard cap on tracked clients, evicting the least recently seen beyond it
+const limiterMaxClients = 100000
+
+type clientBucket struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+//Token bucket per remote IP
+type rateLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+	limit     rate.Limit
+	burst     int
+}
+
+//With -rate set, requests beyond a client's bucket get 429 and Retry-After
+func rateLimit(h http.Handler) http.Handler {
+	if cfg.rate <= 0 {
+		return h
+	}
+	rl := &rateLimiter{clients: make(map[string]*clientBucket), limit: rate.Limit(cfg.rate), burst: cfg.burst}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := probePaths[r.URL.Path]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		res := rl.bucket(clientIP(r)).Reserve()
+		if d := res.Delay(); d > 0 {
+			//Give the token back; this request is refused, not queued
+			res.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (rl *rateLimiter) bucket(ip string) *rate.Limiter {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) > limiterIdle {
+		rl.sweep(now)
+	}
+	b, ok := rl.clients[ip]
+	if !ok {
+		if len(rl.clients) >= limiterMaxClients {
+			rl.evictOldest()
+		}
+		b = &clientBucket{lim: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = b
+	}
+	b.seen = now
+	return b.lim
+}
+
+func (rl *rateLimiter) sweep(now time.Time) {
+	for ip, b := range rl.clients {
+		if now.Sub(b.seen) > limiterIdle {
+			delete(rl.clients, ip)
+		}
+	}
+	rl.lastSweep = now
+}
+
+func (rl *rateLimiter) evictOldest() {
+	var oldest string
+	var seen time.Time
+	for ip, b := range rl.clients {
+		if oldest == "" || b.seen.Before(seen) {
+			oldest, seen = ip, b.seen
+		}
+	}
+	delete(rl.clients, oldest)
+}
+
+//The connecting address; forwarding headers are ignored as clients can forge them
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
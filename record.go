@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+//Same fields as ip2locRec without its JSON methods
+type plainRec ip2locRec
+
+//IPs are emitted as decimal strings so IPv6-sized values survive clients that
+//parse JSON numbers as float64. The value receiver works for both T and *T.
+func (r ip2locRec) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		FromIP string `json:"fromIP"`
+		ToIP   string `json:"toIP"`
+		*plainRec
+	}{r.FromIP.String(), r.ToIP.String(), (*plainRec)(&r)})
+}
+
+func (r *ip2locRec) UnmarshalJSON(b []byte) error {
+	aux := struct {
+		FromIP string `json:"fromIP"`
+		ToIP   string `json:"toIP"`
+		*plainRec
+	}{plainRec: (*plainRec)(r)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if err := setDecimal(&r.FromIP, aux.FromIP); err != nil {
+		return fmt.Errorf("Invalid fromIP: %v", err)
+	}
+	if err := setDecimal(&r.ToIP, aux.ToIP); err != nil {
+		return fmt.Errorf("Invalid toIP: %v", err)
+	}
+	return nil
+}
+
+//An empty string leaves n at zero
+func setDecimal(n *big.Int, s string) error {
+	if s == "" {
+		n.SetInt64(0)
+		return nil
+	}
+	if _, ok := n.SetString(s, 10); !ok {
+		return fmt.Errorf("%q is not a decimal integer", s)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func roundTrip(t *testing.T, rec ip2locRec) ip2locRec {
+	t.Helper()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ip2locRec
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshalling %s: %v", b, err)
+	}
+	return got
+}
+
+func TestRecordBoundsRoundTrip(t *testing.T) {
+	rec := testRec(16777216, 16777471, "AU")
+	rec.CountryName, rec.Region, rec.City = "Australia", "Queensland", "Brisbane"
+	got := roundTrip(t, rec)
+	if got.FromIP.Cmp(&rec.FromIP) != 0 || got.ToIP.Cmp(&rec.ToIP) != 0 {
+		t.Errorf("Bounds came back as %s-%s, want %s-%s", got.FromIP.String(), got.ToIP.String(), rec.FromIP.String(), rec.ToIP.String())
+	}
+	if got.CountryCode != rec.CountryCode || got.City != rec.City {
+		t.Errorf("Round trip gave %+v, want %+v", got, rec)
+	}
+}
+
+func TestRecordLargeIPRoundTrip(t *testing.T) {
+	var rec ip2locRec
+	//2^64 and the top of the IPv6 space, both beyond uint64
+	rec.FromIP.SetString("18446744073709551616", 10)
+	rec.ToIP.SetString("340282366920938463463374607431768211455", 10)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Strings, so clients decoding numbers as float64 lose nothing
+	if !strings.Contains(string(b), `"toIP":"340282366920938463463374607431768211455"`) {
+		t.Errorf("toIP not encoded as a decimal string: %s", b)
+	}
+	got := roundTrip(t, rec)
+	if got.FromIP.Cmp(&rec.FromIP) != 0 || got.ToIP.Cmp(&rec.ToIP) != 0 {
+		t.Errorf("Bounds came back as %s-%s", got.FromIP.String(), got.ToIP.String())
+	}
+
+	for _, bad := range []string{`{"toIP":"1e3"}`, `{"toIP":12}`, `{"fromIP":"-"}`} {
+		if err := json.Unmarshal([]byte(bad), new(ip2locRec)); err == nil {
+			t.Errorf("Unmarshalled %s without an error", bad)
+		}
+	}
+}
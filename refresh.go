@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type refreshStatus struct {
+	Records     int       `json:"records"`
+	LastRefresh time.Time `json:"lastRefresh"`
+}
+
+//Reload the dataset now. A refresh already in flight, from -refresh or
+//another caller, is joined rather than started twice. On failure the
+//previous records stay in place and the load's error is returned, a 502 when
+//upstream is at fault.
+func ip2locRefresh(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return &appError{fmt.Errorf("Method %s not allowed", r.Method), "Refresh requires POST", 405}
+	}
+
+	recs, e := cache.refresh(r.Context())
+	if e != nil {
+		return e
+	}
+	st := refreshStatus{len(recs), cache.lastRefresh()}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(&st); err != nil {
+		return &appError{err, "Error marshalling refresh status", 500}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//A /search result: the record and how far its city is from the query
+type searchHit struct {
+	Distance int        `json:"distance"`
+	Record   *ip2locRec `json:"record"`
+}
+
+//Longest ?city= accepted, in runes. Each search computes an edit distance
+//against every city name, at a cost growing with the query's length.
+const maxSearchQuery = 64
+
+//A city name close to the query
+type cityMatch struct {
+	name     string
+	prefix   bool
+	distance int
+}
+
+//Fuzzy city search over the distinct names indexed at load time. Cities the
+//query is a prefix of rank first, then by edit distance; the records of each
+//city follow in record order until ?limit= (default -search-limit) is reached.
+func ip2locSearch(w http.ResponseWriter, r *http.Request) *appError {
+	q := r.URL.Query()
+	query := strings.ToLower(strings.TrimSpace(q.Get("city")))
+	if query == "" {
+		return &appError{errors.New("Missing city parameter"), "Missing city query parameter", 400}
+	}
+	if n := utf8.RuneCountInString(query); n > maxSearchQuery {
+		return &appError{fmt.Errorf("City query too long: %d characters", n), fmt.Sprintf("City query parameter must be at most %d characters", maxSearchQuery), 400}
+	}
+	limit := cfg.searchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return &appError{fmt.Errorf("Invalid limit %q", v), "Invalid limit query parameter", 400}
+		}
+		limit = n
+	}
+
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	view, _ := cache.snapshot()
+
+	//A typo or two per word, without letting short queries match everything
+	maxDistance := utf8.RuneCountInString(query) / 3
+	var matches []cityMatch
+	for name := range view.byCity {
+		m := cityMatch{name: name, prefix: strings.HasPrefix(name, query)}
+		m.distance = levenshtein(query, name)
+		if m.prefix || m.distance <= maxDistance {
+			matches = append(matches, m)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.prefix != b.prefix {
+			return a.prefix
+		}
+		if a.distance != b.distance {
+			return a.distance < b.distance
+		}
+		return a.name < b.name
+	})
+
+	hits := []searchHit{}
+	for _, m := range matches {
+		for _, i := range view.byCity[m.name] {
+			if len(hits) == limit {
+				break
+			}
+			hits = append(hits, searchHit{m.distance, &view.recs[i]})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		return &appError{err, "Error marshalling IP2Location data", 500}
+	}
+	return nil
+}
+
+//Edit distance between a and b in runes, keeping a single row of the table
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		diag := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			next := min(row[j]+1, row[j-1]+1, diag+cost)
+			diag, row[j] = row[j], next
+		}
+	}
+	return row[len(rb)]
+}
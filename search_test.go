@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//Queries are limited to maxSearchQuery runes, not bytes
+func TestSearchQueryLength(t *testing.T) {
+	useTestData(t)
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"ascii at limit", strings.Repeat("a", maxSearchQuery), 200},
+		{"ascii over limit", strings.Repeat("a", maxSearchQuery+1), 400},
+		{"multibyte at limit", strings.Repeat("é", maxSearchQuery), 200},
+		{"multibyte over limit", strings.Repeat("é", maxSearchQuery+1), 400},
+		{"empty", "", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := get(appHandler(ip2locSearch), "/search?city="+url.QueryEscape(tt.query))
+			if rr.Code != tt.want {
+				t.Errorf("Status %d, want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+		})
+	}
+}
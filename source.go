@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+//The zip (or raw or gzipped CSV) being parsed. Upstream downloads are spooled to a
+//temporary file so they never sit in memory.
+type dataFile struct {
+	*os.File
+	size int64
+	temp bool
+	//Hex SHA-256 of the whole file
+	sha256 string
+
+	//Set on upstream downloads
+	validators validators
+}
+
+//Closes the file, removing it if it was a temporary download
+func (d *dataFile) Close() error {
+	err := d.File.Close()
+	if d.temp {
+		os.Remove(d.Name())
+	}
+	return err
+}
+
+//The local -file if set, otherwise a fresh download from the upstream server.
+//cond is sent upstream so an unchanged dataset returns errNotModified. The
+//data is checked against -checksum, or its digest logged when there is none.
+func openSource(ctx context.Context, cond validators) (*dataFile, error) {
+	return checkSource(openData(ctx, cond, cfg.cacheDir != ""))
+}
+
+//openSource without -cache-dir, so the copy on disk is neither read nor
+//replaced: a dry run must not change what the next refresh starts from
+func openUncached(ctx context.Context, cond validators) (*dataFile, error) {
+	return checkSource(openData(ctx, cond, false))
+}
+
+func checkSource(d *dataFile, err error) (*dataFile, error) {
+	if err != nil {
+		return nil, err
+	}
+	if cfg.checksum == "" {
+		log.Printf("Dataset SHA-256 %s", d.sha256)
+		return d, nil
+	}
+	if err := matchChecksum(d.sha256); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+//An error unless digest is -checksum or none is set
+func matchChecksum(digest string) error {
+	if cfg.checksum == "" || strings.EqualFold(digest, cfg.checksum) {
+		return nil
+	}
+	return sourceError{fmt.Errorf("Checksum mismatch: data has SHA-256 %s, expected %s", digest, cfg.checksum)}
+}
+
+func openData(ctx context.Context, cond validators, diskCache bool) (*dataFile, error) {
+	if cfg.file == "" {
+		if diskCache {
+			return fetchCached(ctx, cfg.upstream, cond)
+		}
+		return fetch(ctx, cfg.upstream, cond)
+	}
+	f, err := os.Open(cfg.file)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dataFile{File: f, size: size, sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+//Downloads and -file data alike are only loaded when they match -checksum
+func TestChecksum(t *testing.T) {
+	zipped := testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV)
+	sum := sha256.Sum256(zipped)
+	digest := hex.EncodeToString(sum[:])
+	other := strings.Repeat("0", len(digest))
+
+	tests := []struct {
+		name     string
+		file     bool
+		checksum string
+		want     int
+	}{
+		{"none", false, "", 200},
+		{"match", false, digest, 200},
+		{"match in upper case", false, strings.ToUpper(digest), 200},
+		{"mismatch", false, other, 502},
+		{"file match", true, digest, 200},
+		{"file mismatch", true, other, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useUpstream(t, testUpstream(t, zipped).URL)
+			if tt.file {
+				cfg.file = writeTemp(t, "data.zip", zipped)
+			}
+			cfg.checksum = tt.checksum
+			rr := get(appHandler(ip2locLookup), "/lookup?ip=1.0.0.5")
+			if rr.Code != tt.want {
+				t.Errorf("Status %d, want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+		})
+	}
+
+	keepConfig(t)
+	cfg.checksum = other
+	if err := matchChecksum(digest); err == nil || !strings.Contains(err.Error(), digest) {
+		t.Errorf("matchChecksum gave %v, want a mismatch naming the data's digest", err)
+	}
+}
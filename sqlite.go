@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+//Decimal digits of the largest IPv6 address
+const ipDigits = 39
+
+//The sqlite subcommand: run the pipeline once and write the records to the
+//database at -db, replacing any ip2loc table already there. Everything
+//happens in one transaction, so a failed export leaves the file as it was.
+//Returns the process exit code.
+func runSQLite() int {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	db, err := sql.Open("sqlite", cfg.db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %s: %v\n", cfg.db, err)
+		return 1
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting transaction: %v\n", err)
+		return 1
+	}
+	defer tx.Rollback()
+
+	//IPs are zero-padded text: exact at IPv6 size, and ordered numerically by
+	//plain string comparison, so the to_ip index serves range queries
+	for _, q := range []string{
+		"DROP TABLE IF EXISTS ip2loc",
+		"CREATE TABLE ip2loc(from_ip TEXT, to_ip TEXT, country TEXT, region TEXT, city TEXT)",
+	} {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating table: %v\n", err)
+			return 1
+		}
+	}
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO ip2loc(from_ip, to_ip, country, region, city) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error preparing insert: %v\n", err)
+		return 1
+	}
+	defer insert.Close()
+
+	var insErr error
+	n := 0
+	res, e := load(ctx, validators{}, func(rec *ip2locRec) {
+		if insErr != nil {
+			return
+		}
+		if _, insErr = insert.ExecContext(ctx, padIP(&rec.FromIP), padIP(&rec.ToIP), rec.CountryCode, rec.Region, rec.City); insErr != nil {
+			cancel()
+			return
+		}
+		n++
+	})
+
+	if insErr != nil {
+		fmt.Fprintf(os.Stderr, "Error inserting records: %v\n", insErr)
+		return 1
+	}
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", e.Message, e.Error)
+		return 1
+	}
+	if _, err := tx.ExecContext(ctx, "CREATE INDEX ip2loc_to_ip ON ip2loc(to_ip)"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating index: %v\n", err)
+		return 1
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error committing records: %v\n", err)
+		return 1
+	}
+	reportSkipped(os.Stderr, res.skipped)
+	fmt.Fprintf(os.Stderr, "Wrote %d records to %s\n", n, cfg.db)
+	return 0
+}
+
+func padIP(n *big.Int) string {
+	return fmt.Sprintf("%0*s", ipDigits, n.String())
+}
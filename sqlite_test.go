@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSQLite(t *testing.T) {
+	keepConfig(t)
+	cfg.file = filepath.Join("testdata", "IPV6-COUNTRY-REGION-CITY.CSV.gz")
+	cfg.db = filepath.Join(t.TempDir(), "ip2loc.db")
+	//The second run replaces the table rather than adding to it
+	for i := 0; i < 2; i++ {
+		if code := runSQLite(); code != 0 {
+			t.Fatalf("runSQLite exited %d", code)
+		}
+	}
+
+	db, err := sql.Open("sqlite", cfg.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	var to, city string
+	if err := db.QueryRow("SELECT COUNT(*), MAX(to_ip) FROM ip2loc").Scan(&n, &to); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || to != padIP(addrInt(t, "1.0.7.255")) {
+		t.Errorf("Table holds %d rows up to %s, want 3 up to 1.0.7.255", n, to)
+	}
+	//Zero padding keeps string order numeric for range queries
+	q := "SELECT city FROM ip2loc WHERE to_ip >= ? ORDER BY to_ip LIMIT 1"
+	if err := db.QueryRow(q, padIP(addrInt(t, "1.0.2.5"))).Scan(&city); err != nil || city != "" {
+		t.Errorf("City for 1.0.2.5 is %q, %v; want none, as CN keeps no cities by default", city, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type datasetStats struct {
+	Records     int            `json:"records"`
+	Countries   map[string]int `json:"countries"`
+	Continents  map[string]int `json:"continents"`
+	WithRegion  int            `json:"withRegion"`
+	WithCity    int            `json:"withCity"`
+	LastRefresh time.Time      `json:"lastRefresh"`
+	//Release date of the data, when it gives one
+	DatasetDate *time.Time `json:"datasetDate,omitempty"`
+
+	//Rows dropped by -lenient, with the errors for the first few
+	SkippedRows   int      `json:"skippedRows"`
+	SkippedSample []string `json:"skippedSample,omitempty"`
+}
+
+func computeStats(recs []ip2locRec, byCountry map[string][]int) *datasetStats {
+	st := &datasetStats{
+		Records:    len(recs),
+		Countries:  make(map[string]int, len(byCountry)),
+		Continents: make(map[string]int),
+	}
+	for code, idx := range byCountry {
+		st.Countries[code] = len(idx)
+		continent, ok := continents[code]
+		if !ok {
+			continent = "Unknown"
+		}
+		st.Continents[continent] += len(idx)
+	}
+	for i := range recs {
+		if recs[i].Region != "" {
+			st.WithRegion++
+		}
+		if recs[i].City != "" {
+			st.WithCity++
+		}
+	}
+	return st
+}
+
+func ip2locStats(w http.ResponseWriter, r *http.Request) *appError {
+	if _, e := cache.get(r.Context()); e != nil {
+		return e
+	}
+	summary, loadedAt := cache.stats()
+	st := *summary
+	st.LastRefresh = loadedAt
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(&st); err != nil {
+		return &appError{err, "Error marshalling IP2Location stats", 500}
+	}
+	return nil
+}
+
+//Tags every response with X-Dataset-Date once the loaded data gives one, so
+//clients can tell which release answered them
+func datasetDateHeader(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := cache.dataDate(); !t.IsZero() {
+			w.Header().Set("X-Dataset-Date", t.Format(time.RFC3339))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
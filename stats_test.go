@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//The release date reaches X-Dataset-Date and /stats from the zip member's
+//modification time, the gzip header's, or else upstream's Last-Modified
+func TestDatasetDate(t *testing.T) {
+	fixture := func(name string) []byte {
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		name         string
+		data         []byte
+		lastModified string
+		want         string
+	}{
+		{"zip", fixture("IPV6-COUNTRY-REGION-CITY.CSV.zip"), "Sat, 01 Aug 2026 00:00:00 GMT", "2026-09-01T00:00:00Z"},
+		{"gzip", fixture("IPV6-COUNTRY-REGION-CITY.CSV.gz"), "", "2026-09-01T00:00:00Z"},
+		{"csv", []byte(testCSV), "Sat, 01 Aug 2026 00:00:00 GMT", "2026-08-01T00:00:00Z"},
+		{"none", []byte(testCSV), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.lastModified != "" {
+					w.Header().Set("Last-Modified", tt.lastModified)
+				}
+				w.Write(tt.data)
+			}))
+			t.Cleanup(srv.Close)
+			useUpstream(t, srv.URL)
+			if _, e := cache.get(t.Context()); e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+
+			rr := get(datasetDateHeader(appHandler(ip2locStats)), "/stats")
+			if rr.Code != 200 {
+				t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+			}
+			if got := rr.Header().Get("X-Dataset-Date"); got != tt.want {
+				t.Errorf("X-Dataset-Date %q, want %q", got, tt.want)
+			}
+			var st datasetStats
+			if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if st.DatasetDate != nil {
+				got = st.DatasetDate.Format(time.RFC3339)
+			}
+			if got != tt.want {
+				t.Errorf("/stats datasetDate %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
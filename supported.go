@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//Runtime changes to supportedCountries under /countries/{code}. Cached
+//records only pick up the change once they are parsed again, so every change
+//starts a background reload.
+func ip2locCountry(w http.ResponseWriter, r *http.Request) *appError {
+	code := strings.TrimPrefix(r.URL.Path, "/countries/")
+	if strings.Contains(code, "/") {
+		return &appError{fmt.Errorf("No route for %s", r.URL.Path), "Not found", 404}
+	}
+	if len(code) != 2 {
+		return &appError{fmt.Errorf("Invalid country code %q", code), "Country code must be two letters", 400}
+	}
+	code = strings.ToUpper(code)
+	if _, ok := isoCountries[code]; !ok {
+		return &appError{fmt.Errorf("Unknown country code %q", code), "Unknown country code", 400}
+	}
+
+	switch r.Method {
+	case "PUT":
+		supportedMu.Lock()
+		supportedCountries[code] = struct{}{}
+		supportedMu.Unlock()
+	case "DELETE":
+		supportedMu.Lock()
+		_, ok := supportedCountries[code]
+		delete(supportedCountries, code)
+		supportedMu.Unlock()
+		if !ok {
+			return &appError{fmt.Errorf("Country %s is not supported", code), "Country is not in the supported set", 404}
+		}
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		return &appError{fmt.Errorf("Method %s not allowed", r.Method), "Supported countries are changed with PUT or DELETE", 405}
+	}
+
+	cache.reparse()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type supportedCountry struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+//GET /countries: the supported countries sorted by code, read under the same
+//lock as the changes above
+func ip2locCountries(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		return &appError{fmt.Errorf("Method %s not allowed", r.Method), "Supported countries are listed with GET", 405}
+	}
+
+	supportedMu.RLock()
+	list := make([]supportedCountry, 0, len(supportedCountries))
+	for code := range supportedCountries {
+		list = append(list, supportedCountry{code, isoCountries[code]})
+	}
+	supportedMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		return &appError{err, "Error marshalling supported countries", 500}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+//The supported codes GET /countries lists
+func listSupported(t *testing.T) []string {
+	t.Helper()
+	rr := get(appHandler(ip2locCountries), "/countries")
+	var list []supportedCountry
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Decoding /countries: %v: %s", err, rr.Body)
+	}
+	codes := make([]string, len(list))
+	for i, c := range list {
+		codes[i] = c.Code
+	}
+	return codes
+}
+
+//Waits for the background reload a change starts to give the record for ip
+//the region want
+func waitForRegion(t *testing.T, ip, want string) {
+	t.Helper()
+	n := addrInt(t, ip)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		view, _ := cache.snapshot()
+		rec, _ := view.lookup(n)
+		if rec.Region == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Record for %s has region %q, want %q", ip, rec.Region, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//Serves data under a fixed ETag, answering 304 to a fetch that already has
+//it. Every fetch after the first waits for release.
+func newETagUpstream(t *testing.T, data []byte) *gatedUpstream {
+	u := &gatedUpstream{release: make(chan struct{})}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u.hits.Add(1) > 1 {
+			select {
+			case <-u.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+//Blocks until upstream has been asked for the data n times
+func waitForHits(t *testing.T, u *gatedUpstream, n int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for u.hits.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Upstream fetched %d times, want %d", u.hits.Load(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//A change made while a refresh is already asking upstream for changes since
+//the cached version still reaches the records, though that refresh gets a
+//304 and keeps them
+func TestCountryPutDuringLoad(t *testing.T) {
+	up := newETagUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+	keepSupported(t)
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	waitForRegion(t, "1.0.2.5", "")
+
+	cache.background()
+	waitForHits(t, up, 2)
+	if rr := serveRequest(appHandler(ip2locCountry), httptest.NewRequest("PUT", "/countries/cn", nil)); rr.Code != 204 {
+		t.Fatalf("PUT answered %d, want 204: %s", rr.Code, rr.Body)
+	}
+	close(up.release)
+	waitForRegion(t, "1.0.2.5", "Fujian")
+}
+
+//Likewise for a country removed mid-refresh
+func TestCountryDeleteDuringLoad(t *testing.T) {
+	up := newETagUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+	keepSupported(t)
+	supportedMu.Lock()
+	supportedCountries["CN"] = struct{}{}
+	supportedMu.Unlock()
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	waitForRegion(t, "1.0.2.5", "Fujian")
+
+	cache.background()
+	waitForHits(t, up, 2)
+	if rr := serveRequest(appHandler(ip2locCountry), httptest.NewRequest("DELETE", "/countries/cn", nil)); rr.Code != 204 {
+		t.Fatalf("DELETE answered %d, want 204: %s", rr.Code, rr.Body)
+	}
+	close(up.release)
+	waitForRegion(t, "1.0.2.5", "")
+}
+
+func TestCountryPutDelete(t *testing.T) {
+	useTestData(t)
+	keepSupported(t)
+	if _, e := cache.get(context.Background()); e != nil {
+		t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+	}
+	h := appHandler(ip2locCountry)
+	send := func(method, path string) int {
+		return serveRequest(h, httptest.NewRequest(method, path, nil)).Code
+	}
+	waitForRegion(t, "1.0.2.5", "")
+
+	if code := send("PUT", "/countries/cn"); code != 204 {
+		t.Fatalf("PUT answered %d, want 204", code)
+	}
+	if got := listSupported(t); !slices.Contains(got, "CN") {
+		t.Errorf("Supported %v after PUT, want CN among them", got)
+	}
+	waitForRegion(t, "1.0.2.5", "Fujian")
+
+	if code := send("DELETE", "/countries/CN"); code != 204 {
+		t.Fatalf("DELETE answered %d, want 204", code)
+	}
+	if got := listSupported(t); slices.Contains(got, "CN") {
+		t.Errorf("Supported %v after DELETE, want CN gone", got)
+	}
+	waitForRegion(t, "1.0.2.5", "")
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"DELETE", "/countries/CN", 404},
+		{"PUT", "/countries/XX", 400},
+		{"PUT", "/countries/USA", 400},
+		{"POST", "/countries/CN", 405},
+	} {
+		if code := send(tt.method, tt.path); code != tt.want {
+			t.Errorf("%s %s answered %d, want %d", tt.method, tt.path, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//Records the test's spans in memory
+func recordSpans(t testing.TB) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	saved := tracer
+	tracer = tp.Tracer("adsGO-csv-parser")
+	t.Cleanup(func() { tracer = saved })
+	return sr
+}
+
+//Requests sharing a load each get a link from its span, and fetch, read and
+//parse are children of it
+func TestLoadSpanLinksRequests(t *testing.T) {
+	sr := recordSpans(t)
+	up := newGatedUpstream(t, testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", testCSV))
+	useUpstream(t, up.URL)
+
+	const requests = 2
+	h := traceRequests(appHandler(ip2locLookup))
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr := get(h, "/lookup?ip=1.0.0.5"); rr.Code != 200 {
+				t.Errorf("Status %d: %s", rr.Code, rr.Body)
+			}
+		}()
+	}
+	waitForWaiters(t, requests)
+	close(up.release)
+	wg.Wait()
+
+	spans := sr.Ended()
+	byName := map[string][]sdktrace.ReadOnlySpan{}
+	for _, s := range spans {
+		byName[s.Name()] = append(byName[s.Name()], s)
+	}
+	if n := len(byName["load"]); n != 1 {
+		t.Fatalf("%d load spans, want 1", n)
+	}
+	load := byName["load"][0]
+	if load.Parent().IsValid() {
+		t.Errorf("Load span has parent %v, want a root", load.Parent().SpanID())
+	}
+
+	var linked []trace.SpanID
+	for _, l := range load.Links() {
+		linked = append(linked, l.SpanContext.SpanID())
+	}
+	reqs := byName["HTTP GET"]
+	if len(reqs) != requests {
+		t.Fatalf("%d request spans, want %d", len(reqs), requests)
+	}
+	for _, r := range reqs {
+		if !slices.Contains(linked, r.SpanContext().SpanID()) {
+			t.Errorf("Load span links %v, missing request %v", linked, r.SpanContext().SpanID())
+		}
+	}
+
+	for _, name := range []string{"fetch", "read", "parse"} {
+		if len(byName[name]) != 1 {
+			t.Errorf("%d %s spans, want 1", len(byName[name]), name)
+			continue
+		}
+		if got := byName[name][0].Parent().SpanID(); got != load.SpanContext().SpanID() {
+			t.Errorf("%s span has parent %v, want the load span %v", name, got, load.SpanContext().SpanID())
+		}
+	}
+}
+
+//A dry run is part of its request, so its spans are children of the request's
+func TestValidateSpansAreChildren(t *testing.T) {
+	sr := recordSpans(t)
+	useTestData(t)
+
+	rr := serveRequest(traceRequests(appHandler(ip2locValidate)), httptest.NewRequest("POST", "/validate", nil))
+	if rr.Code != 200 {
+		t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+	}
+	var req trace.SpanID
+	for _, s := range sr.Ended() {
+		if s.Name() == "HTTP POST" {
+			req = s.SpanContext().SpanID()
+		}
+	}
+	if !req.IsValid() {
+		t.Fatal("No request span")
+	}
+	fetched := false
+	for _, s := range sr.Ended() {
+		if s.Name() != "fetch" {
+			continue
+		}
+		fetched = true
+		if s.Parent().SpanID() != req {
+			t.Errorf("Fetch span has parent %v, want the request %v", s.Parent().SpanID(), req)
+		}
+	}
+	if !fetched {
+		t.Error("No fetch span")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+//n contiguous IPv4 ranges of uneven, mostly unaligned sizes covering the
+//whole space, like IP2Location's: a range ends wherever the next country's
+//allocation starts
+func ipv4Recs(n int, seed int64) []ip2locRec {
+	rng := rand.New(rand.NewSource(seed))
+	recs := make([]ip2locRec, n)
+	avg := int64(1<<32) / int64(n)
+	from := int64(0)
+	for i := range recs {
+		to := from + rng.Int63n(2*avg) + 1
+		if i == n-1 || to > 1<<32-1 {
+			to = 1<<32 - 1
+		}
+		recs[i] = testRec(from, to, "US")
+		if to == 1<<32-1 {
+			return recs[:i+1]
+		}
+		from = to + 1
+	}
+	return recs
+}
+
+//recs moved to ::ffff:0:0/96, the layout of IP2Location's IPv6 editions
+func mappedRecs(recs []ip2locRec) []ip2locRec {
+	mapped := make([]ip2locRec, len(recs))
+	for i, r := range recs {
+		mapped[i] = r
+		mapped[i].FromIP.Add(v4Mapped, &r.FromIP)
+		mapped[i].ToIP.Add(v4Mapped, &r.ToIP)
+	}
+	return mapped
+}
+
+func TestTrieMatchesBinarySearch(t *testing.T) {
+	for _, layout := range []struct {
+		name string
+		recs []ip2locRec
+		base *big.Int
+	}{
+		{"ipv4", ipv4Recs(10000, 1), new(big.Int)},
+		{"mapped", mappedRecs(ipv4Recs(10000, 1)), v4Mapped},
+	} {
+		t.Run(layout.name, func(t *testing.T) {
+			recs := layout.recs
+			trie := buildTrie(recs)
+			rng := rand.New(rand.NewSource(2))
+			for i := 0; i < 100000; i++ {
+				ip := new(big.Int).Add(layout.base, big.NewInt(rng.Int63n(1<<32)))
+				if !trie.covers(ip) {
+					t.Fatalf("Trie does not cover %s", ip)
+				}
+				want, wantOK := lookup(recs, ip)
+				got, ok := trie.find(recs, ip)
+				if ok != wantOK || got.FromIP.Cmp(&want.FromIP) != 0 {
+					t.Fatalf("trie.find(%s) = %s, %v; binary search gives %s, %v", ip, got.FromIP.String(), ok, want.FromIP.String(), wantOK)
+				}
+			}
+			//Bounds of every range, where an off-by-one in a prefix would show
+			for i := range recs {
+				for _, ip := range []*big.Int{&recs[i].FromIP, &recs[i].ToIP} {
+					if got, ok := trie.find(recs, ip); !ok || got.FromIP.Cmp(&recs[i].FromIP) != 0 {
+						t.Fatalf("trie.find(%s) = %s, %v; want the range from %s", ip, got.FromIP.String(), ok, recs[i].FromIP.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+//Heap bytes held by what build returns
+func retained(build func() any) (any, uint64) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return v, after.HeapAlloc - before.HeapAlloc
+}
+
+//A dataset the size of IP2Location's IPv4 ranges, in the IPv4 layout and in
+//the IPv6 editions' ::ffff:0:0/96. Reports each index's memory per record
+//alongside lookup speed.
+func BenchmarkLookupIndex(b *testing.B) {
+	for _, bench := range []struct {
+		layout string
+		n      int
+	}{{"ipv4", 10000}, {"ipv4", 1 << 20}, {"mapped", 10000}, {"mapped", 1 << 20}} {
+		n, base := bench.n, new(big.Int)
+		v, recBytes := retained(func() any { return ipv4Recs(n, 1) })
+		if bench.layout == "mapped" {
+			base = v4Mapped
+			v, recBytes = retained(func() any { return mappedRecs(ipv4Recs(n, 1)) })
+		}
+		recs := v.([]ip2locRec)
+		v, trieBytes := retained(func() any { return buildTrie(recs) })
+		trie := v.(*ipv4Trie)
+		ips := make([]*big.Int, 4096)
+		rng := rand.New(rand.NewSource(2))
+		for i := range ips {
+			ips[i] = new(big.Int).Add(base, big.NewInt(rng.Int63n(1<<32)))
+		}
+
+		b.Run(fmt.Sprintf("%s/binary/%d", bench.layout, len(recs)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				lookup(recs, ips[i%len(ips)])
+			}
+			b.ReportMetric(float64(recBytes)/float64(len(recs)), "B/record")
+		})
+		b.Run(fmt.Sprintf("%s/trie/%d", bench.layout, len(recs)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				trie.find(recs, ips[i%len(ips)])
+			}
+			b.ReportMetric(float64(recBytes+trieBytes)/float64(len(recs)), "B/record")
+			b.ReportMetric(float64(len(trie.nodes))/float64(len(recs)), "nodes/record")
+			b.ReportMetric(float64(unsafe.Sizeof(trieNode{})), "B/node")
+		})
+		runtime.KeepAlive(trie)
+	}
+}
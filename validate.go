@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//Outcome of a dry-run load
+type validationReport struct {
+	Valid   bool   `json:"valid"`
+	Records int    `json:"records"`
+	Error   string `json:"error,omitempty"`
+
+	//Rows dropped by -lenient, with the errors for the first few
+	SkippedRows   int      `json:"skippedRows"`
+	SkippedSample []string `json:"skippedSample,omitempty"`
+}
+
+//Fetch and parse the current upstream data with the live settings, reporting
+//what a refresh would load without swapping it into the cache or on disk.
+//The records are only counted, so a dry run costs no more memory than a
+//normal refresh.
+func ip2locValidate(w http.ResponseWriter, r *http.Request) *appError {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return &appError{fmt.Errorf("Method %s not allowed", r.Method), "Validation requires POST", 405}
+	}
+
+	n := 0
+	//Unconditional, so an unchanged upstream is still parsed. Neither the copy
+	//in -cache-dir nor /progress is touched, as the cache holds on to neither.
+	res, e := loadFrom(r.Context(), openUncached, nil, validators{}, func(*ip2locRec) {
+		n++
+	})
+	if e != nil && r.Context().Err() != nil {
+		return e
+	}
+	rep := validationReport{Valid: e == nil}
+	if e != nil {
+		rep.Error = fmt.Sprintf("%s: %v", e.Message, e.Error)
+	} else {
+		rep.Records = n
+		rep.SkippedRows, rep.SkippedSample = res.skipped.count, res.skipped.sample
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(&rep); err != nil {
+		return &appError{err, "Error marshalling validation report", 500}
+	}
+	return nil
+}
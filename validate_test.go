@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+//A dry run reports the upstream data as it is now, but leaves the copy in
+//-cache-dir and the last /progress result for the data being served
+func TestValidateIsDryRun(t *testing.T) {
+	var data atomic.Pointer[[]byte]
+	serve := func(csv string) {
+		b := testZip(t, "IPV6-COUNTRY-REGION-CITY.CSV", csv)
+		data.Store(&b)
+	}
+	serve(testCSV)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(*data.Load())
+	}))
+	t.Cleanup(srv.Close)
+	useUpstream(t, srv.URL)
+	cfg.cacheDir = t.TempDir()
+
+	if _, e := cache.get(t.Context()); e != nil {
+		t.Fatalf("Loading: %s: %v", e.Message, e.Error)
+	}
+	dataPath, metaPath := diskCachePaths()
+	readCache := func() []byte {
+		t.Helper()
+		b, err := os.ReadFile(dataPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err := os.ReadFile(metaPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(b, meta...)
+	}
+	onDisk, last := readCache(), progress.result()
+
+	serve(testCSV + `"16779264","16781311","CN","China","Guangdong","Guangzhou"` + "\n")
+	rr := serveRequest(appHandler(ip2locValidate), httptest.NewRequest("POST", "/validate", nil))
+	if rr.Code != 200 {
+		t.Fatalf("Status %d: %s", rr.Code, rr.Body)
+	}
+	var rep validationReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Valid || rep.Records != 4 {
+		t.Errorf("Report %+v, want 4 valid records", rep)
+	}
+
+	if !bytes.Equal(readCache(), onDisk) {
+		t.Error("Dry run replaced the copy in -cache-dir")
+	}
+	progress.mu.Lock()
+	active := progress.active
+	progress.mu.Unlock()
+	if got := progress.result(); active || got != last {
+		t.Errorf("Progress %+v (active %v) after the dry run, want %+v", got, active, last)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+//General purpose flag bits of a zip entry
+const (
+	zipFlagEncrypted  = 0x1
+	zipFlagDescriptor = 0x8
+)
+
+//Compression method WinZip AES entries are stored under
+const zipMethodAES = 99
+
+//The CSV member's contents, decrypting it with -zip-password when it uses
+//traditional PKWARE encryption (ZipCrypto). archive/zip neither decrypts nor
+//flags encrypted entries, so they are read raw and decompressed here.
+func openMember(f *zip.File) (io.ReadCloser, error) {
+	if f.Flags&zipFlagEncrypted == 0 {
+		return f.Open()
+	}
+	if f.Method == zipMethodAES {
+		return nil, sourceError{fmt.Errorf("%s is AES encrypted; only ZipCrypto passwords are supported", f.Name)}
+	}
+	if cfg.zipPassword == "" {
+		return nil, sourceError{fmt.Errorf("%s is encrypted: set -zip-password", f.Name)}
+	}
+
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, sourceError{err}
+	}
+	z := newZipCrypto([]byte(cfg.zipPassword))
+	//The 12 byte header ends in a check byte: the CRC's high byte, or the
+	//modification time's when the CRC follows the data in a descriptor
+	var header [12]byte
+	if _, err := io.ReadFull(raw, header[:]); err != nil {
+		return nil, sourceError{fmt.Errorf("Reading encryption header of %s: %v", f.Name, err)}
+	}
+	z.decrypt(header[:])
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&zipFlagDescriptor != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if header[11] != check {
+		return nil, sourceError{fmt.Errorf("Wrong -zip-password for %s", f.Name)}
+	}
+
+	plain := &zipCryptoReader{raw, z}
+	var rc io.ReadCloser
+	switch f.Method {
+	case zip.Store:
+		rc = io.NopCloser(plain)
+	case zip.Deflate:
+		rc = flate.NewReader(plain)
+	default:
+		return nil, sourceError{fmt.Errorf("%s uses unsupported compression method %d", f.Name, f.Method)}
+	}
+	return &crcCheckReader{rc: rc, h: crc32.NewIEEE(), want: f.CRC32, name: f.Name}, nil
+}
+
+//Key state of the traditional PKWARE stream cipher
+type zipCrypto struct {
+	k0, k1, k2 uint32
+}
+
+func newZipCrypto(password []byte) *zipCrypto {
+	z := &zipCrypto{0x12345678, 0x23456789, 0x34567890}
+	for _, b := range password {
+		z.update(b)
+	}
+	return z
+}
+
+func (z *zipCrypto) update(b byte) {
+	z.k0 = crc32Byte(z.k0, b)
+	z.k1 = (z.k1+z.k0&0xff)*134775813 + 1
+	z.k2 = crc32Byte(z.k2, byte(z.k1>>24))
+}
+
+//Decrypts buf in place
+func (z *zipCrypto) decrypt(buf []byte) {
+	for i, c := range buf {
+		t := z.k2 | 2
+		p := c ^ byte(t*(t^1)>>8)
+		z.update(p)
+		buf[i] = p
+	}
+}
+
+//One step of the raw CRC-32 the cipher is built on, without the usual
+//pre- and post-inversion
+func crc32Byte(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ crc>>8
+}
+
+type zipCryptoReader struct {
+	r io.Reader
+	z *zipCrypto
+}
+
+func (r *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.z.decrypt(p[:n])
+	return n, err
+}
+
+//Compares the decrypted data against the entry's CRC, as zip.File.Open does;
+//a mismatch at EOF means the data or the password is wrong
+type crcCheckReader struct {
+	rc   io.ReadCloser
+	h    hash.Hash32
+	want uint32
+	name string
+}
+
+func (r *crcCheckReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && r.h.Sum32() != r.want {
+		return n, sourceError{fmt.Errorf("Checksum mismatch in %s: corrupt data or wrong -zip-password", r.name)}
+	}
+	return n, err
+}
+
+func (r *crcCheckReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Fixtures made by Info-ZIP from testCSV's three countries: zip -P secret,
+//zip -0 -P secret, and piped in so the member is named - and deflated as a
+//stream
+func TestZipCryptoFixtures(t *testing.T) {
+	tests := []struct {
+		file     string
+		csvName  string
+		password string
+		wantErr  string
+	}{
+		{"zipcrypto.zip", "", "secret", ""},
+		{"zipcrypto-stored.zip", "", "secret", ""},
+		{"zipcrypto-stdin.zip", "-", "secret", ""},
+		{"zipcrypto.zip", "", "", "set -zip-password"},
+		{"zipcrypto.zip", "", "wrong", "Wrong -zip-password"},
+		{"zipcrypto-stored.zip", "", "wrong", "Wrong -zip-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+"/"+tt.password, func(t *testing.T) {
+			keepConfig(t)
+			cfg.file = filepath.Join("testdata", tt.file)
+			if tt.csvName != "" {
+				cfg.csvName = tt.csvName
+			}
+			cfg.zipPassword = tt.password
+			recs, e := loadAll()
+			if tt.wantErr != "" {
+				if e == nil || !strings.Contains(e.Error.Error(), tt.wantErr) {
+					t.Fatalf("Load error %v, want one saying %q", e, tt.wantErr)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("Load failed: %s: %v", e.Message, e.Error)
+			}
+			if len(recs) != 3 || recs[2].City != "Los Angeles" {
+				t.Errorf("Loaded %+v, want testCSV's three countries", recs)
+			}
+		})
+	}
+}